@@ -1,37 +1,85 @@
 import 'dart:convert';
 import 'dart:io';
 
+import 'invite.dart';
+
 /// Client configuration.
 class Config {
   final String psk;
   final int socksPort;
   final String firebaseProject;
   final String firebaseCredentials;
+  /// Service account key carried inline by an invite, instead of a file.
+  final Map<String, dynamic>? firebaseServiceAccount;
   final String senderId;
   final String peerFcmToken;
+  final List<String> peerFcmTokens;
+  final bool disableCompression;
+  final String webPushServerKey;
 
   Config({
     required this.psk,
     this.socksPort = 1080,
     required this.firebaseProject,
     required this.firebaseCredentials,
+    this.firebaseServiceAccount,
     required this.senderId,
     required this.peerFcmToken,
+    this.peerFcmTokens = const [],
+    this.disableCompression = false,
+    this.webPushServerKey = '',
   });
 
   factory Config.fromJson(Map<String, dynamic> json) {
+    final creds = json['firebase_credentials'];
     return Config(
       psk: json['psk'] as String,
       socksPort: (json['socks_port'] as int?) ?? 1080,
       firebaseProject: json['firebase_project'] as String,
-      firebaseCredentials: json['firebase_credentials'] as String,
+      firebaseCredentials: creds is String ? creds : '',
+      firebaseServiceAccount: creds is Map<String, dynamic> ? creds : null,
       senderId: json['sender_id'] as String,
       peerFcmToken: (json['peer_fcm_token'] as String?) ?? '',
+      peerFcmTokens:
+          ((json['peer_fcm_tokens'] as List?) ?? const []).cast<String>(),
+      disableCompression: (json['disable_compression'] as bool?) ?? false,
+      webPushServerKey: (json['webpush_server_key'] as String?) ?? '',
     );
   }
 
+  /// peer_fcm_token and peer_fcm_tokens merged, without duplicates.
+  List<String> get allPeerTokens => {
+        if (peerFcmToken.isNotEmpty) peerFcmToken,
+        ...peerFcmTokens.where((t) => t.isNotEmpty),
+      }.toList();
+
+  /// Load the config file at [path], which may also be a ptun:// invite.
+  /// An invite (given directly or as "invite") fills in whatever the config
+  /// leaves unset.
   static Future<Config> load(String path) async {
-    final contents = await File(path).readAsString();
-    return Config.fromJson(json.decode(contents) as Map<String, dynamic>);
+    final Map<String, dynamic> cfg = isInvite(path)
+        ? {'invite': path}
+        : json.decode(await File(path).readAsString()) as Map<String, dynamic>;
+
+    final invite = cfg['invite'] as String? ?? '';
+    if (invite.isNotEmpty) {
+      var passphrase = cfg['invite_passphrase'] as String? ?? '';
+      if (passphrase.isEmpty) {
+        passphrase = Platform.environment['PTUN_INVITE_PASSPHRASE'] ?? '';
+      }
+      final inv = await decodeInvite(invite, passphrase: passphrase);
+      cfg.putIfAbsent('psk', () => inv['key']);
+      for (final k in const [
+        'firebase_project',
+        'firebase_credentials',
+        'sender_id',
+        'peer_fcm_tokens',
+        'webpush_server_key',
+      ]) {
+        if (inv[k] != null) cfg.putIfAbsent(k, () => inv[k]);
+      }
+      print('Imported invite for user "${inv['name']}"');
+    }
+    return Config.fromJson(cfg);
   }
 }
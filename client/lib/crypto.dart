@@ -5,12 +5,17 @@ import 'dart:typed_data';
 import 'package:cryptography/cryptography.dart';
 
 const String _hkdfSalt = 'push-tunnel-v1';
+const String _keyIdInfo = 'push-tunnel-key-id';
 const int _keySize = 32;
 const int _nonceSize = 12;
 
 /// AES-256-GCM encryption matching the Go server implementation.
 class TunnelCrypto {
   late final SecretKey _key;
+
+  /// Short public identifier of the key, sent in the "u" data key so a relay
+  /// serving several users knows which key sealed a message.
+  late final String keyId;
   final AesGcm _algo = AesGcm.with256bits();
 
   TunnelCrypto._();
@@ -26,6 +31,14 @@ class TunnelCrypto {
       info: <int>[],
     );
     c._key = derived;
+    final id = await Hkdf(hmac: Hmac(Sha256()), outputLength: 4).deriveKey(
+      secretKey: ikm,
+      nonce: utf8.encode(_hkdfSalt),
+      info: utf8.encode(_keyIdInfo),
+    );
+    c.keyId = (await id.extractBytes())
+        .map((b) => b.toRadixString(16).padLeft(2, '0'))
+        .join();
     return c;
   }
 
@@ -44,7 +57,11 @@ class TunnelCrypto {
 
   /// Decrypt base64-encoded ciphertext.
   Future<Uint8List> decrypt(String encoded) async {
-    final data = base64.decode(encoded);
+    return decryptBytes(base64.decode(encoded));
+  }
+
+  /// Decrypt raw nonce[12] || ciphertext || tag[16].
+  Future<Uint8List> decryptBytes(List<int> data) async {
     if (data.length < _nonceSize + 16) {
       throw FormatException('Ciphertext too short');
     }
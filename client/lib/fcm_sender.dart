@@ -21,6 +21,11 @@ class FCMSender {
     return FCMSender._(project: project, serviceAccount: data);
   }
 
+  /// Create an FCM sender from an already parsed service account key.
+  static FCMSender fromServiceAccount(Map<String, dynamic> serviceAccount, String project) {
+    return FCMSender._(project: project, serviceAccount: serviceAccount);
+  }
+
   /// Send an FCM data message to the given token.
   Future<void> sendData(String fcmToken, Map<String, String> data) async {
     final token = await _getAccessToken();
@@ -1,6 +1,8 @@
 import 'dart:async';
 import 'dart:convert';
+import 'dart:io';
 import 'dart:math';
+import 'dart:typed_data';
 
 import 'crypto.dart';
 import 'fcm_sender.dart';
@@ -11,25 +13,58 @@ import 'protocol.dart';
 const int _maxChunkDataSize = 3072;
 const Duration _chunkTimeout = Duration(seconds: 30);
 
+// Per-message flags carried in the "f" data key (must match the relay).
+const int _flagCompressed = 0x01;
+const int _flagAcceptCompress = 0x02;
+const int _flagAcceptCodecs = 0x04;
+
+// Web push raw_data framing (must match the relay's webpush.go).
+const int _rfc8188HeaderSize = 21;
+const int _rawEnvelopeSize = 11;
+
+const String _z85Alphabet =
+    '0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%\$#';
+
+// Shared DEFLATE dictionary; must match compressDict in the relay byte for byte.
+const String _compressDict =
+    'HTTP/1.1 200 OK\r\nHTTP/1.1 301 Moved Permanently\r\nHTTP/1.1 304 Not Modified\r\n'
+    'GET / HTTP/1.1\r\nPOST / HTTP/1.1\r\nHost: \r\nUser-Agent: Mozilla/5.0 \r\n'
+    'Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n'
+    'Accept-Encoding: gzip, deflate, br\r\nAccept-Language: en-US,en;q=0.9\r\n'
+    'Connection: keep-alive\r\nContent-Type: text/html; charset=utf-8\r\n'
+    'Content-Type: application/json\r\nContent-Length: \r\nTransfer-Encoding: chunked\r\n'
+    'Cache-Control: no-cache\r\nCookie: \r\nSet-Cookie: \r\nDate: \r\nServer: \r\n'
+    'Location: https://\r\nLast-Modified: \r\nETag: \r\nVary: Accept-Encoding\r\n\r\n'
+    '<!DOCTYPE html><html><head><meta charset="utf-8"><title></title>'
+    '<script src=""></script><link rel="stylesheet" href=""></head><body><div class=""></div></body></html>';
+
 /// FCM transport orchestrator: send frames via FCM HTTP v1 API,
 /// receive frames via MCS client, with chunking/reassembly.
 class FCMTransport {
   final TunnelCrypto crypto;
   final FCMSender sender;
-  final String peerToken;
+  /// The relay's FCM tokens (one per relay identity); sends rotate over them.
+  final List<String> peerTokens;
+  int _nextPeer = 0;
   final void Function(Frame) onFrame;
 
+  /// Whether we compress outgoing frames (once the peer accepts compression).
+  final bool compress;
+  bool _peerCompress = false;
+
   MCSClient? mcs;
 
   // Chunk reassembly state.
   final Map<String, _ChunkGroup> _chunkBuffer = {};
+  final Map<String, _RawChunkGroup> _rawChunkBuffer = {};
   Timer? _chunkCleaner;
 
   FCMTransport({
     required this.crypto,
     required this.sender,
-    required this.peerToken,
+    required this.peerTokens,
     required this.onFrame,
+    this.compress = true,
   });
 
   /// Start the chunk cleaner.
@@ -46,14 +81,29 @@ class FCMTransport {
 
   /// Send a frame to the peer via FCM.
   Future<void> sendFrame(Frame frame) async {
-    final raw = frame.encode();
+    var raw = frame.encode();
+
+    var flags = _flagAcceptCodecs;
+    if (compress) {
+      flags |= _flagAcceptCompress;
+      if (_peerCompress) {
+        final packed = _deflate(raw);
+        if (packed.length < raw.length) {
+          raw = packed;
+          flags |= _flagCompressed;
+        }
+      }
+    }
+
     final encrypted = await crypto.encrypt(raw);
     final encBytes = utf8.encode(encrypted);
 
     if (encBytes.length <= _maxChunkDataSize) {
-      await sender.sendData(peerToken, {
+      await sender.sendData(_pickPeer(), {
         'type': 'weather_alert',
+        'u': crypto.keyId,
         'd': encrypted,
+        if (flags != 0) 'f': flags.toString(),
       });
       return;
     }
@@ -64,16 +114,32 @@ class FCMTransport {
     final ct = chunks.length.toString();
 
     for (int i = 0; i < chunks.length; i++) {
-      await sender.sendData(peerToken, {
+      await sender.sendData(_pickPeer(), {
         'type': 'weather_alert',
+        'u': crypto.keyId,
         'mid': mid,
         'ci': i.toString(),
         'ct': ct,
         'd': chunks[i],
+        if (flags != 0) 'f': flags.toString(),
       });
     }
   }
 
+  /// Replace the relay's tokens, e.g. after it re-registered with FCM.
+  void setPeerTokens(List<String> tokens) {
+    if (tokens.isEmpty) return;
+    peerTokens
+      ..clear()
+      ..addAll(tokens);
+    _nextPeer = 0;
+  }
+
+  String _pickPeer() {
+    if (peerTokens.isEmpty) throw StateError('No peer FCM token configured');
+    return peerTokens[_nextPeer++ % peerTokens.length];
+  }
+
   /// Handle an incoming MCS DataMessage.
   void handleMCSMessage(DataMessage dm) {
     print('[fcm-transport] received MCS message from=${dm.from} category=${dm.category} keys=${dm.appDataList.map((a) => a.key).toList()}');
@@ -82,30 +148,96 @@ class FCMTransport {
       data[kv.key] = kv.value;
     }
 
+    if (dm.rawData.isNotEmpty) {
+      _handleRaw(dm);
+      return;
+    }
+
+    final flags = int.tryParse(data['f'] ?? '') ?? 0;
+    _notePeerFlags(flags);
+
     final mid = data['mid'];
     if (mid != null && mid.isNotEmpty) {
       _handleChunked(data);
       return;
     }
 
-    final encrypted = data['d'];
-    if (encrypted == null || encrypted.isEmpty) return;
+    final encoded = _joinPayload(data);
+    if (encoded.isEmpty) return;
+
+    _decryptAndDeliver(encoded, data['e'] ?? '', flags);
+  }
+
+  void _notePeerFlags(int flags) {
+    if ((flags & _flagAcceptCompress) != 0 && compress && !_peerCompress) {
+      print('[fcm-transport] peer accepts compression; enabling');
+      _peerCompress = true;
+    }
+  }
+
+  /// Handle a binary web push payload: an RFC 8188 header, then
+  /// [flags][chunk index][chunk count][8-byte message id], then sealed bytes.
+  void _handleRaw(DataMessage dm) {
+    if (dm.contentEncoding != 'aes128gcm') {
+      print('[fcm-transport] unsupported raw_data content-encoding ${dm.contentEncoding}');
+      return;
+    }
+    final body = dm.rawData;
+    if (body.length < _rfc8188HeaderSize ||
+        body.length < _rfc8188HeaderSize + body[20] + _rawEnvelopeSize) {
+      print('[fcm-transport] raw_data too short: ${body.length}');
+      return;
+    }
+    final off = _rfc8188HeaderSize + body[20];
+    final flags = body[off];
+    final ci = body[off + 1];
+    final ct = body[off + 2];
+    final mid = 'raw:' +
+        body
+            .sublist(off + 3, off + _rawEnvelopeSize)
+            .map((b) => b.toRadixString(16).padLeft(2, '0'))
+            .join();
+    final chunk = Uint8List.sublistView(body, off + _rawEnvelopeSize);
+    _notePeerFlags(flags);
+
+    if (ct == 0 || ci >= ct) {
+      print('[fcm-transport] invalid raw chunk: mid=$mid ci=$ci ct=$ct');
+      return;
+    }
+    if (ct == 1) {
+      _deliverSealed(chunk, flags);
+      return;
+    }
+
+    final group = _rawChunkBuffer.putIfAbsent(
+        mid, () => _RawChunkGroup(total: ct, flags: flags));
+    group.chunks[ci] = chunk;
+    if (group.chunks.length < group.total) return;
+    _rawChunkBuffer.remove(mid);
 
-    _decryptAndDeliver(encrypted);
+    final assembled = BytesBuilder();
+    for (var i = 0; i < group.total; i++) {
+      assembled.add(group.chunks[i]!);
+    }
+    _deliverSealed(assembled.takeBytes(), group.flags);
   }
 
   void _handleChunked(Map<String, String> data) {
     final mid = data['mid']!;
     final ci = int.tryParse(data['ci'] ?? '') ?? -1;
     final ct = int.tryParse(data['ct'] ?? '') ?? 0;
-    final chunk = data['d'] ?? '';
+    final chunk = _joinPayload(data);
 
     if (ct <= 0 || ci < 0 || ci >= ct || chunk.isEmpty) {
       print('[fcm-transport] invalid chunk: mid=$mid ci=$ci ct=$ct');
       return;
     }
 
-    final group = _chunkBuffer.putIfAbsent(mid, () => _ChunkGroup(total: ct));
+    final group = _chunkBuffer.putIfAbsent(mid,
+        () => _ChunkGroup(
+            total: ct,
+            flags: int.tryParse(data['f'] ?? '') ?? 0,
+            codec: data['e'] ?? ''));
     group.chunks[ci] = chunk;
 
     if (group.chunks.length < group.total) return;
@@ -119,12 +251,32 @@ class FCMTransport {
       assembled.write(group.chunks[i]!);
     }
 
-    _decryptAndDeliver(assembled.toString());
+    _decryptAndDeliver(assembled.toString(), group.codec, group.flags);
+  }
+
+  Future<void> _decryptAndDeliver(String encoded, String codec, int flags) async {
+    try {
+      final List<int> sealed;
+      switch (codec) {
+        case '':
+          sealed = base64.decode(encoded);
+        case 'z':
+          sealed = _z85Decode(encoded);
+        default:
+          throw FormatException('Unknown payload codec: $codec');
+      }
+      await _deliverSealed(sealed, flags);
+    } catch (e) {
+      print('[fcm-transport] decode error: $e');
+    }
   }
 
-  Future<void> _decryptAndDeliver(String encrypted) async {
+  Future<void> _deliverSealed(List<int> sealed, int flags) async {
     try {
-      final plaintext = await crypto.decrypt(encrypted);
+      var plaintext = await crypto.decryptBytes(sealed);
+      if ((flags & _flagCompressed) != 0) {
+        plaintext = _inflate(plaintext);
+      }
       final frame = Frame.decode(plaintext);
       onFrame(frame);
     } catch (e) {
@@ -134,6 +286,8 @@ class FCMTransport {
 
   void _cleanStaleChunks() {
     final now = DateTime.now();
+    _rawChunkBuffer.removeWhere(
+        (mid, group) => now.difference(group.received) > _chunkTimeout);
     _chunkBuffer.removeWhere((mid, group) {
       if (now.difference(group.received) > _chunkTimeout) {
         print('[fcm-transport] dropping stale chunk group $mid '
@@ -144,6 +298,55 @@ class FCMTransport {
     });
   }
 
+  /// Reassemble a payload spread across the "d", "d1", "d2", ... keys.
+  static String _joinPayload(Map<String, String> data) {
+    final sb = StringBuffer(data['d'] ?? '');
+    for (var i = 1; data.containsKey('d$i'); i++) {
+      sb.write(data['d$i']);
+    }
+    return sb.toString();
+  }
+
+  /// Decode the relay's Z85 variant: a leading padding digit, then Z85.
+  static Uint8List _z85Decode(String s) {
+    if (s.isEmpty || (s.length - 1) % 5 != 0) {
+      throw FormatException('Invalid Z85 length: ${s.length}');
+    }
+    final pad = s.codeUnitAt(0) - 0x30;
+    if (pad < 0 || pad > 3) {
+      throw FormatException('Invalid Z85 padding marker');
+    }
+    final out = BytesBuilder();
+    for (var i = 1; i < s.length; i += 5) {
+      var v = 0;
+      for (var j = 0; j < 5; j++) {
+        final d = _z85Alphabet.indexOf(s[i + j]);
+        if (d < 0) throw FormatException('Invalid Z85 character: ${s[i + j]}');
+        v = v * 85 + d;
+      }
+      if (v > 0xffffffff) throw FormatException('Z85 block overflow');
+      out.add([(v >> 24) & 0xff, (v >> 16) & 0xff, (v >> 8) & 0xff, v & 0xff]);
+    }
+    final bytes = out.takeBytes();
+    if (pad > bytes.length) throw FormatException('Z85 padding exceeds payload');
+    return Uint8List.sublistView(bytes, 0, bytes.length - pad);
+  }
+
+  static Uint8List _deflate(Uint8List data) {
+    final codec = ZLibCodec(
+        raw: true, level: 9, dictionary: utf8.encode(_compressDict));
+    return Uint8List.fromList(codec.encode(data));
+  }
+
+  static Uint8List _inflate(Uint8List data) {
+    final codec = ZLibCodec(raw: true, dictionary: utf8.encode(_compressDict));
+    final out = codec.decode(data);
+    if (out.length > frameHeaderSize + maxPayloadSize) {
+      throw FormatException('Inflated payload too large: ${out.length}');
+    }
+    return Uint8List.fromList(out);
+  }
+
   static String _randomMessageId() {
     final rng = Random.secure();
     final bytes = List.generate(8, (_) => rng.nextInt(256));
@@ -162,8 +365,19 @@ class FCMTransport {
 
 class _ChunkGroup {
   final int total;
+  final int flags;
+  final String codec;
   final Map<int, String> chunks = {};
   final DateTime received = DateTime.now();
 
-  _ChunkGroup({required this.total});
+  _ChunkGroup({required this.total, this.flags = 0, this.codec = ''});
+}
+
+class _RawChunkGroup {
+  final int total;
+  final int flags;
+  final Map<int, Uint8List> chunks = {};
+  final DateTime received = DateTime.now();
+
+  _RawChunkGroup({required this.total, required this.flags});
 }
@@ -6,17 +6,21 @@ import 'package:http/http.dart' as http;
 const String _checkinUrl = 'https://android.clients.google.com/checkin';
 const String _registerUrl = 'https://android.clients.google.com/c2dm/register3';
 const String _credsFile = 'gcm_credentials.json';
+// App id of the web push registration; must stay stable across runs.
+const String _webPushSubtype = 'wp:https://weatherpulse.app/#push-tunnel';
 
 /// GCM device credentials (androidId, securityToken, FCM token).
 class GCMCredentials {
   final int androidId;
   final int securityToken;
   final String fcmToken;
+  String webPushToken;
 
   GCMCredentials({
     required this.androidId,
     required this.securityToken,
     required this.fcmToken,
+    this.webPushToken = '',
   });
 
   factory GCMCredentials.fromJson(Map<String, dynamic> json) {
@@ -24,6 +28,7 @@ class GCMCredentials {
       androidId: json['android_id'] as int,
       securityToken: json['security_token'] as int,
       fcmToken: json['fcm_token'] as String,
+      webPushToken: (json['webpush_token'] as String?) ?? '',
     );
   }
 
@@ -31,6 +36,7 @@ class GCMCredentials {
         'android_id': androidId,
         'security_token': securityToken,
         'fcm_token': fcmToken,
+        if (webPushToken.isNotEmpty) 'webpush_token': webPushToken,
       };
 }
 
@@ -51,7 +57,8 @@ Future<GCMCredentials> registerGCM(String senderId) async {
   print('[gcm] checkin ok: androidId=${checkin.$1}');
 
   // Step 2: Register.
-  final fcmToken = await _doRegister(checkin.$1, checkin.$2, senderId);
+  final fcmToken =
+      await _doRegister(checkin.$1, checkin.$2, senderId, senderId);
   print('[gcm] registered, token=${fcmToken.substring(0, 20)}...');
 
   final creds = GCMCredentials(
@@ -64,6 +71,16 @@ Future<GCMCredentials> registerGCM(String senderId) async {
   return creds;
 }
 
+/// Obtain a web push token registered against the relay's VAPID public key
+/// so the relay can send binary raw_data payloads. Reuses a saved token.
+Future<void> registerWebPush(GCMCredentials creds, String appServerKey) async {
+  if (creds.webPushToken.isNotEmpty) return;
+  creds.webPushToken = await _doRegister(
+      creds.androidId, creds.securityToken, _webPushSubtype, appServerKey);
+  print('[gcm] registered for web push, token=${creds.webPushToken.substring(0, 20)}...');
+  await _saveCredentials(creds);
+}
+
 Future<(int, int)> _doCheckin() async {
   final body = json.encode({
     'checkin': {
@@ -101,12 +118,15 @@ Future<(int, int)> _doCheckin() async {
   return (androidId, securityToken);
 }
 
-Future<String> _doRegister(int androidId, int securityToken, String senderId) async {
+/// Register app id [subtype] for pushes from [sender], which is either a
+/// numeric sender ID or a base64url VAPID public key.
+Future<String> _doRegister(
+    int androidId, int securityToken, String subtype, String sender) async {
   final body = Uri(queryParameters: {
     'app': 'org.chromium.linux',
-    'X-subtype': senderId,
+    'X-subtype': subtype,
     'device': androidId.toString(),
-    'sender': senderId,
+    'sender': sender,
   }).query;
 
   final resp = await http.post(
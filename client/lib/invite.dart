@@ -0,0 +1,73 @@
+import 'dart:convert';
+
+import 'package:cryptography/cryptography.dart';
+
+// Invite format; must match the relay's invite.go.
+const String _invitePrefix = 'ptun://';
+const String _inviteVersion = 'v1';
+const String _inviteVersionSealed = 'v1e';
+const int _inviteKdfIterations = 200000;
+const int _inviteSaltSize = 16;
+const int _nonceSize = 12;
+const int _macSize = 16;
+
+/// Whether [s] looks like a ptun:// invite.
+bool isInvite(String s) => s.trim().startsWith(_invitePrefix);
+
+/// Decode a ptun:// invite into its JSON object. [passphrase] is only
+/// needed for encrypted (v1e) invites.
+Future<Map<String, dynamic>> decodeInvite(String s, {String passphrase = ''}) async {
+  s = s.trim();
+  if (!s.startsWith(_invitePrefix)) {
+    throw FormatException('invite: missing ptun:// prefix');
+  }
+  final rest = s.substring(_invitePrefix.length);
+  final slash = rest.indexOf('/');
+  if (slash < 0) throw FormatException('invite: missing version');
+  final version = rest.substring(0, slash);
+  List<int> raw = base64Url.decode(base64Url.normalize(rest.substring(slash + 1)));
+
+  switch (version) {
+    case _inviteVersion:
+      break;
+    case _inviteVersionSealed:
+      if (passphrase.isEmpty) {
+        throw FormatException('invite: encrypted, passphrase required');
+      }
+      if (raw.length < _inviteSaltSize + _nonceSize + _macSize) {
+        throw FormatException('invite: truncated');
+      }
+      final pbkdf2 = Pbkdf2(
+        macAlgorithm: Hmac(Sha256()),
+        iterations: _inviteKdfIterations,
+        bits: 256,
+      );
+      final key = await pbkdf2.deriveKey(
+        secretKey: SecretKey(utf8.encode(passphrase)),
+        nonce: raw.sublist(0, _inviteSaltSize),
+      );
+      final box = SecretBox.fromConcatenation(
+        raw.sublist(_inviteSaltSize),
+        nonceLength: _nonceSize,
+        macLength: _macSize,
+      );
+      try {
+        raw = await AesGcm.with256bits().decrypt(
+          box,
+          secretKey: key,
+          aad: utf8.encode(_inviteVersionSealed),
+        );
+      } on SecretBoxAuthenticationError {
+        throw FormatException('invite: wrong passphrase or corrupted invite');
+      }
+      break;
+    default:
+      throw FormatException('invite: unsupported version "$version"');
+  }
+
+  final inv = json.decode(utf8.decode(raw)) as Map<String, dynamic>;
+  if ((inv['key'] as String? ?? '').isEmpty) {
+    throw FormatException('invite: no key');
+  }
+  return inv;
+}
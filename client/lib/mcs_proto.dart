@@ -277,12 +277,19 @@ class DataMessage {
   final List<AppData> appDataList;
   final String persistentId;
 
+  /// Binary web push body (field 21); empty for plain data messages.
+  final Uint8List rawData;
+
   DataMessage({
     required this.from,
     required this.category,
     required this.appDataList,
     required this.persistentId,
-  });
+    Uint8List? rawData,
+  }) : rawData = rawData ?? Uint8List(0);
+
+  /// Web push content coding of [rawData] ("aes128gcm" or "aesgcm").
+  String get contentEncoding => getAppDataValue('content-encoding');
 
   String getAppDataValue(String key) {
     for (final kv in appDataList) {
@@ -304,11 +311,20 @@ DataMessage parseDataMessageStanza(Uint8List data) {
     ));
   }
 
+  Uint8List? rawData;
+  for (final f in fields) {
+    if (f.fieldNum == 21 && f.wireType == 2) {
+      rawData = Uint8List.fromList(f.data);
+      break;
+    }
+  }
+
   return DataMessage(
     from: getStringField(fields, 3),
     category: getStringField(fields, 5),
     appDataList: appData,
     persistentId: getStringField(fields, 9),
+    rawData: rawData,
   );
 }
 
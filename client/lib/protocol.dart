@@ -6,6 +6,12 @@ class FrameType {
   static const int data = 0x02;
   static const int disconnect = 0x03;
   static const int ack = 0x04;
+  /// Control frame announcing the sender's FCM tokens (JSON payload).
+  static const int tokens = 0x05;
+  /// Control frame introducing the client and its FCM tokens (JSON payload).
+  static const int hello = 0x06;
+  /// Relay self-test frame; only ever sent by a relay to itself.
+  static const int probe = 0x07;
 }
 
 const int frameHeaderSize = 5;
@@ -1,5 +1,6 @@
 import 'dart:async';
 import 'dart:collection';
+import 'dart:convert';
 import 'dart:typed_data';
 
 import 'config.dart';
@@ -39,6 +40,9 @@ class TunnelClient {
   final Queue<Frame> _sendQueue = Queue();
   Timer? _batchTimer;
 
+  /// Re-sends HELLO until the relay answers with its tokens.
+  Timer? _helloTimer;
+
   TunnelClient({required this.config, required this.crypto});
 
   /// Start the tunnel client: register with GCM, start MCS, begin sending.
@@ -46,24 +50,31 @@ class TunnelClient {
     // Register with GCM to get our FCM token.
     _creds = await registerGCM(config.senderId);
 
-    print('');
-    print('=== FCM Token (copy to peer\'s config as peer_fcm_token) ===');
-    print(_creds.fcmToken);
-    print('============================================================');
-    print('');
+    print('[tunnel] FCM token ${_creds.fcmToken} (sent to the relay in HELLO)');
+
+    if (config.webPushServerKey.isNotEmpty) {
+      await registerWebPush(_creds, config.webPushServerKey);
+      print('[tunnel] web push token ${_creds.webPushToken} (sent to the relay in HELLO)');
+    }
 
     // Create FCM sender.
-    final sender = await FCMSender.create(
-      config.firebaseCredentials,
-      config.firebaseProject,
-    );
+    final sender = config.firebaseServiceAccount != null
+        ? FCMSender.fromServiceAccount(
+            config.firebaseServiceAccount!,
+            config.firebaseProject,
+          )
+        : await FCMSender.create(
+            config.firebaseCredentials,
+            config.firebaseProject,
+          );
 
     // Create FCM transport.
     _transport = FCMTransport(
       crypto: crypto,
       sender: sender,
-      peerToken: config.peerFcmToken,
+      peerTokens: config.allPeerTokens,
       onFrame: _handleDownstreamFrame,
+      compress: !config.disableCompression,
     );
 
     // Start MCS client for receiving.
@@ -82,6 +93,10 @@ class TunnelClient {
       _flushSendQueue();
     });
 
+    // Introduce ourselves so the relay learns where to send.
+    _sendHello();
+    _helloTimer = Timer.periodic(const Duration(seconds: 60), (_) => _sendHello());
+
     print('[tunnel] client started (FCM mode)');
   }
 
@@ -185,9 +200,30 @@ class TunnelClient {
           _cleanupChannel(frame.channelId);
         }
         break;
+
+      case FrameType.tokens:
+        // The relay's answer to HELLO, or news that it re-registered.
+        _helloTimer?.cancel();
+        final msg = json.decode(utf8.decode(frame.payload)) as Map<String, dynamic>;
+        final tokens = (msg['fcm_tokens'] as List?)?.cast<String>() ?? const [];
+        print('[tunnel] relay announced ${tokens.length} FCM token(s)');
+        _transport.setPeerTokens(tokens);
+        break;
     }
   }
 
+  void _sendHello() {
+    final payload = json.encode({
+      'fcm_tokens': [_creds.fcmToken],
+      if (_creds.webPushToken.isNotEmpty) 'webpush_token': _creds.webPushToken,
+    });
+    _enqueueFrame(Frame(
+      type: FrameType.hello,
+      channelId: 0,
+      payload: Uint8List.fromList(utf8.encode(payload)),
+    ));
+  }
+
   void _enqueueFrame(Frame frame) {
     _sendQueue.add(frame);
   }
@@ -215,6 +251,7 @@ class TunnelClient {
 
   void stop() {
     _batchTimer?.cancel();
+    _helloTimer?.cancel();
     _transport.stop();
     for (final id in _channels.keys.toList()) {
       _cleanupChannel(id);
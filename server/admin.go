@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAdmin serves the admin endpoints on addr, apart from the decoy
+// listener so they are never exposed alongside it. Every request must carry
+// "Authorization: Bearer <token>"; the control socket serves the session
+// routes without one.
+//
+//	/metrics   Prometheus text format
+//	/sessions  sessions and their channels; see sessionRoutes
+func serveAdmin(addr, token string, srv *Server) (*http.Server, error) {
+	if token == "" {
+		return nil, errors.New("admin endpoints need a token")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	registerServerMetrics(srv)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteText(w)
+	})
+	sessionRoutes(mux, srv)
+
+	admin := &http.Server{Handler: requireToken(token, mux)}
+	go func() {
+		if err := admin.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			adminLog.Error("serving failed", errAttr(err))
+		}
+	}()
+	adminLog.Info("listening", "addr", ln.Addr().String())
+	return admin, nil
+}
+
+// requireToken lets through only requests bearing token; an empty token
+// lets everything through.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="push-tunnel"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SessionInfo describes a session and its open channels.
+type SessionInfo struct {
+	Session     string        `json:"session"`
+	Created     time.Time     `json:"created"`
+	QueueLength int           `json:"queue_length"` // frames waiting to be sent to the client
+	Usage       UsageTotals   `json:"usage"`        // since usage_since
+	UsageSince  time.Time     `json:"usage_since"`  // the last usage report
+	Channels    []ChannelInfo `json:"channels"`
+}
+
+// ChannelInfo describes an open channel and the traffic it has carried.
+type ChannelInfo struct {
+	ID         uint16    `json:"id"`
+	Target     string    `json:"target"`
+	Opened     time.Time `json:"opened"`
+	AgeSeconds int64     `json:"age_seconds"`
+	BytesUp    uint64    `json:"bytes_up"`   // sent to the target
+	BytesDown  uint64    `json:"bytes_down"` // received from the target
+	FramesUp   uint64    `json:"frames_up"`
+	FramesDown uint64    `json:"frames_down"`
+}
+
+func sessionInfo(s *Session, usageSince time.Time) SessionInfo {
+	info := SessionInfo{
+		Session:     s.DeviceID,
+		Created:     s.Created,
+		QueueLength: len(s.downstream),
+		Usage:       s.usage.Totals(),
+		UsageSince:  usageSince,
+		Channels:    []ChannelInfo{},
+	}
+	for _, ch := range s.Channels() {
+		info.Channels = append(info.Channels, channelInfo(ch))
+	}
+	return info
+}
+
+func channelInfo(ch *Channel) ChannelInfo {
+	return ChannelInfo{
+		ID:         ch.ID,
+		Target:     ch.Target,
+		Opened:     ch.Opened,
+		AgeSeconds: int64(time.Since(ch.Opened).Seconds()),
+		BytesUp:    ch.BytesUp(),
+		BytesDown:  ch.BytesDown(),
+		FramesUp:   ch.FramesUp(),
+		FramesDown: ch.FramesDown(),
+	}
+}
+
+// sessionRoutes lets an operator see and cut what the relay is carrying.
+// Closing a channel tells the client with a DISCONNECT, as if the target
+// had hung up; closing a session closes all of its channels but keeps the
+// peer, which may open new ones.
+//
+//	GET    /sessions                         every session
+//	GET    /sessions/<session>               one session
+//	DELETE /sessions/<session>               close its channels
+//	GET    /sessions/<session>/channels/<id> one channel
+//	DELETE /sessions/<session>/channels/<id> close it
+func sessionRoutes(mux *http.ServeMux, srv *Server) {
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		sessions := srv.sessions.All()
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].DeviceID < sessions[j].DeviceID })
+		infos := make([]SessionInfo, len(sessions))
+		for i, s := range sessions {
+			infos[i] = sessionInfo(s, srv.sessions.usage.Since())
+		}
+		writeJSON(w, infos)
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		sessionID, channel, isChannel := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/channels/")
+		session := srv.sessions.Get(sessionID)
+		if session == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		if !isChannel {
+			switch r.Method {
+			case http.MethodGet:
+				writeJSON(w, sessionInfo(session, srv.sessions.usage.Since()))
+			case http.MethodDelete:
+				channels := session.ChannelCount()
+				session.CloseAll()
+				adminLog.Info("closed the session's channels", "session", sessionID, "channels", channels)
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+			}
+			return
+		}
+
+		id, err := strconv.ParseUint(channel, 10, 16)
+		var ch *Channel
+		if err == nil {
+			ch = session.GetChannel(uint16(id))
+		}
+		if ch == nil {
+			http.Error(w, "no such channel", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, channelInfo(ch))
+		case http.MethodDelete:
+			session.RemoveChannel(ch.ID)
+			adminLog.Info("closed channel", "session", sessionID, "channel", ch.ID, "target", ch.Target)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// registerServerMetrics adds the metrics read from srv's state when scraped.
+func registerServerMetrics(srv *Server) {
+	metrics.sampled("push_tunnel_start_time_seconds", "When the relay started, in unix seconds.", "gauge",
+		func(emit func(float64, ...string)) {
+			emit(float64(srv.started.Unix()))
+		})
+	metrics.sampled("push_tunnel_sessions", "Open sessions.", "gauge",
+		func(emit func(float64, ...string)) {
+			emit(float64(len(srv.sessions.All())))
+		})
+	metrics.sampled("push_tunnel_channels_open", "Open channels by session.", "gauge",
+		func(emit func(float64, ...string)) {
+			for _, s := range srv.sessions.All() {
+				emit(float64(s.ChannelCount()), s.DeviceID)
+			}
+		}, "session")
+	metrics.sampled("push_tunnel_session_queue_length", "Frames queued for the client by session.", "gauge",
+		func(emit func(float64, ...string)) {
+			for _, s := range srv.sessions.All() {
+				emit(float64(len(s.downstream)), s.DeviceID)
+			}
+		}, "session")
+	metrics.sampled("push_tunnel_peer_tokens", "Known FCM tokens of each peer.", "gauge",
+		func(emit func(float64, ...string)) {
+			for id, p := range srv.Peers() {
+				emit(float64(len(p.transport.PeerTokens())), id)
+			}
+		}, "session")
+
+	// MCS, per identity.
+	identities := func(fn func(emit func(float64, ...string), i string, m MCSStatus)) func(func(float64, ...string)) {
+		return func(emit func(float64, ...string)) {
+			for i, m := range srv.mcs {
+				fn(emit, strconv.Itoa(i), m.Status())
+			}
+		}
+	}
+	metrics.sampled("push_tunnel_mcs_logged_in", "Whether the identity's MCS connection is logged in.", "gauge",
+		identities(func(emit func(float64, ...string), i string, m MCSStatus) {
+			emit(boolValue(m.State == MCSLoggedIn), i)
+		}), "identity")
+	metrics.sampled("push_tunnel_mcs_reconnects_total", "MCS reconnect attempts.", "counter",
+		identities(func(emit func(float64, ...string), i string, m MCSStatus) {
+			emit(float64(m.Reconnects), i)
+		}), "identity")
+	metrics.sampled("push_tunnel_mcs_unacked", "Stanzas sent over MCS and not yet acknowledged.", "gauge",
+		identities(func(emit func(float64, ...string), i string, m MCSStatus) {
+			emit(float64(m.Unacked), i)
+		}), "identity")
+	metrics.sampled("push_tunnel_mcs_last_message_timestamp_seconds", "When MCS last delivered a message, in unix seconds.", "gauge",
+		identities(func(emit func(float64, ...string), i string, m MCSStatus) {
+			if !m.LastMessage.IsZero() {
+				emit(float64(m.LastMessage.Unix()), i)
+			}
+		}), "identity")
+
+	metrics.sampled("push_tunnel_selftest_passed", "Whether the last self-test passed.", "gauge",
+		func(emit func(float64, ...string)) {
+			if srv.selfTest != nil {
+				if st := srv.selfTest.Last(); st != nil {
+					emit(boolValue(st.Passed))
+				}
+			}
+		})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
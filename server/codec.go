@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PayloadCodec turns sealed ciphertext into a string that can travel as an
+// FCM data value, and back.
+//
+// FCM counts its ~4KB limit in bytes of the JSON payload, so a codec is only
+// worth using if it packs more bits per byte than base64's 6. Z85 gives 6.4;
+// base-32768 style encodings pack 15 bits into a 3-byte UTF-8 rune (5 bits per
+// byte) and therefore lose to base64, so they are not offered.
+type PayloadCodec interface {
+	// ID is the short identifier sent in the "e" data key. base64 uses the
+	// empty ID so messages from older peers decode unchanged.
+	ID() string
+	Encode(data []byte) string
+	Decode(s string) ([]byte, error)
+}
+
+// flagAcceptCodecs advertises that the sender understands the "e" codec key
+// and payloads spread across several data keys.
+const flagAcceptCodecs = 0x04
+
+// CodecByName returns the codec for a config name ("base64" or "z85").
+func CodecByName(name string) (PayloadCodec, error) {
+	switch strings.ToLower(name) {
+	case "", "base64":
+		return base64Codec{}, nil
+	case "z85", "base85":
+		return z85Codec{}, nil
+	}
+	return nil, fmt.Errorf("unknown payload codec %q", name)
+}
+
+// codecByID returns the codec for the "e" data key of a received message.
+func codecByID(id string) (PayloadCodec, error) {
+	switch id {
+	case "":
+		return base64Codec{}, nil
+	case "z":
+		return z85Codec{}, nil
+	}
+	return nil, fmt.Errorf("unknown payload codec id %q", id)
+}
+
+type base64Codec struct{}
+
+func (base64Codec) ID() string { return "" }
+
+func (base64Codec) Encode(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func (base64Codec) Decode(s string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode: %w", err)
+	}
+	return data, nil
+}
+
+// z85Alphabet is the ZeroMQ Z85 alphabet. It has no quote or backslash, but
+// json.Marshal would escape its &, < and >, so the FCM request body is
+// encoded without HTML escaping.
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+var z85Decode = func() [256]byte {
+	var t [256]byte
+	for i := range t {
+		t[i] = 0xff
+	}
+	for i := 0; i < len(z85Alphabet); i++ {
+		t[z85Alphabet[i]] = byte(i)
+	}
+	return t
+}()
+
+// z85Codec is Z85 with arbitrary input length: the input is zero-padded to a
+// multiple of four and the first character records the padding length.
+type z85Codec struct{}
+
+func (z85Codec) ID() string { return "z" }
+
+func (z85Codec) Encode(data []byte) string {
+	pad := (4 - len(data)%4) % 4
+	var sb strings.Builder
+	sb.Grow(1 + (len(data)+pad)/4*5)
+	sb.WriteByte(byte('0' + pad))
+
+	var block [5]byte
+	for i := 0; i < len(data); i += 4 {
+		var v uint32
+		for j := 0; j < 4; j++ {
+			v <<= 8
+			if i+j < len(data) {
+				v |= uint32(data[i+j])
+			}
+		}
+		for j := 4; j >= 0; j-- {
+			block[j] = z85Alphabet[v%85]
+			v /= 85
+		}
+		sb.Write(block[:])
+	}
+	return sb.String()
+}
+
+func (z85Codec) Decode(s string) ([]byte, error) {
+	if len(s) == 0 || (len(s)-1)%5 != 0 {
+		return nil, errors.New("z85: invalid length")
+	}
+	pad := int(s[0] - '0')
+	if pad < 0 || pad > 3 {
+		return nil, errors.New("z85: invalid padding marker")
+	}
+	s = s[1:]
+	out := make([]byte, 0, len(s)/5*4)
+	for i := 0; i < len(s); i += 5 {
+		var v uint64
+		for j := 0; j < 5; j++ {
+			d := z85Decode[s[i+j]]
+			if d == 0xff {
+				return nil, fmt.Errorf("z85: invalid character %q", s[i+j])
+			}
+			v = v*85 + uint64(d)
+		}
+		if v > 0xffffffff {
+			return nil, errors.New("z85: block overflow")
+		}
+		out = append(out, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	if pad > len(out) {
+		return nil, errors.New("z85: padding exceeds payload")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// payloadKey returns the data key holding the i-th part of a payload spread
+// across several keys: "d", "d1", "d2", ...
+func payloadKey(i int) string {
+	if i == 0 {
+		return "d"
+	}
+	return "d" + strconv.Itoa(i)
+}
+
+// putPayload stores encoded in data, split evenly across up to n keys.
+func putPayload(data map[string]string, encoded string, n int) {
+	if n <= 1 || len(encoded) < n {
+		data["d"] = encoded
+		return
+	}
+	size := (len(encoded) + n - 1) / n
+	for i := 0; len(encoded) > 0; i++ {
+		end := size
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		data[payloadKey(i)] = encoded[:end]
+		encoded = encoded[end:]
+	}
+}
+
+// joinPayload reassembles a payload written by putPayload.
+func joinPayload(data map[string]string) string {
+	first := data["d"]
+	if _, ok := data["d1"]; !ok {
+		return first
+	}
+	var sb strings.Builder
+	sb.WriteString(first)
+	for i := 1; ; i++ {
+		part, ok := data[payloadKey(i)]
+		if !ok {
+			break
+		}
+		sb.WriteString(part)
+	}
+	return sb.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// z85Vectors pin the encoding the Dart client must produce: the first is the
+// example from the Z85 spec, the others cover each padding length.
+var z85Vectors = []struct {
+	data, encoded string
+}{
+	{"", "0"},
+	{"864fd26fb559f75b", "0HelloWorld"},
+	{"864fd2", "1Helj$"},
+	{"864f", "2Hed^H"},
+	{"86", "3H5.hN"},
+	{"864fd26fb5", "3HelloWeZgb"},
+}
+
+func TestZ85Vectors(t *testing.T) {
+	for _, v := range z85Vectors {
+		data, _ := hex.DecodeString(v.data)
+		if got := (z85Codec{}).Encode(data); got != v.encoded {
+			t.Errorf("Encode(%s) = %q, want %q", v.data, got, v.encoded)
+		}
+		got, err := (z85Codec{}).Decode(v.encoded)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Decode(%q) = %x, %v, want %s", v.encoded, got, err, v.data)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []PayloadCodec{base64Codec{}, z85Codec{}} {
+		// 0 to 12 bytes covers every padding length a few times over.
+		for n := 0; n <= 12; n++ {
+			data := make([]byte, n)
+			for i := range data {
+				data[i] = byte(0xff - i*37)
+			}
+			encoded := codec.Encode(data)
+			got, err := codec.Decode(encoded)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%T: %d bytes: Decode(%q) = %x, %v", codec, n, encoded, got, err)
+			}
+			if strings.ContainsAny(encoded, `"\`) {
+				t.Errorf("%T: %q needs JSON escaping", codec, encoded)
+			}
+		}
+	}
+}
+
+func TestZ85DecodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",            // no padding marker
+		"0Hell",       // not a whole block
+		"0HelloWorl",  // nor here
+		"4HelloWorld", // padding marker out of range
+		"/HelloWorld", // nor here
+		"0Hello\"orld",
+		"0Hello orld",
+		"0#####", // more than 32 bits
+		"1",      // padding without a block
+	} {
+		if got, err := (z85Codec{}).Decode(s); err == nil {
+			t.Errorf("Decode(%q) = %x, want an error", s, got)
+		}
+	}
+}
+
+func TestPutPayload(t *testing.T) {
+	for _, tc := range []struct {
+		encoded string
+		n       int
+		want    map[string]string
+	}{
+		{"abcdefg", 0, map[string]string{"d": "abcdefg"}},
+		{"abcdefg", 1, map[string]string{"d": "abcdefg"}},
+		{"abcdefg", 3, map[string]string{"d": "abc", "d1": "def", "d2": "g"}},
+		{"abcdefg", 4, map[string]string{"d": "ab", "d1": "cd", "d2": "ef", "d3": "g"}},
+		{"abcdef", 3, map[string]string{"d": "ab", "d1": "cd", "d2": "ef"}},
+		{"abcd", 4, map[string]string{"d": "a", "d1": "b", "d2": "c", "d3": "d"}},
+		// Fewer keys than asked for when the parts would not all be filled.
+		{"abcdef", 5, map[string]string{"d": "ab", "d1": "cd", "d2": "ef"}},
+		// More keys than characters: it all goes in "d".
+		{"abc", 5, map[string]string{"d": "abc"}},
+		{"", 3, map[string]string{"d": ""}},
+	} {
+		data := make(map[string]string)
+		putPayload(data, tc.encoded, tc.n)
+		if !reflect.DeepEqual(data, tc.want) {
+			t.Errorf("putPayload(%q, %d) = %v, want %v", tc.encoded, tc.n, data, tc.want)
+		}
+		if got := joinPayload(data); got != tc.encoded {
+			t.Errorf("joinPayload(%v) = %q, want %q", data, got, tc.encoded)
+		}
+	}
+}
+
+// TestJoinPayloadOtherKeys checks that the other keys of a message do not
+// end up in its payload.
+func TestJoinPayloadOtherKeys(t *testing.T) {
+	data := map[string]string{"type": "weather_alert", "f": "4", "e": "z", "mid": "ab", "d": "x", "d1": "y", "d3": "lost"}
+	if got := joinPayload(data); got != "xy" {
+		t.Errorf("joinPayload = %q, want %q", got, "xy")
+	}
+}
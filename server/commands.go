@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// commandFlags holds the flags shared by every command.
+type commandFlags struct {
+	*flag.FlagSet
+	config   string
+	listen   string
+	psk      string
+	stateDir string
+}
+
+func newCommandFlags(name string) *commandFlags {
+	f := &commandFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError), listen: ":8080"}
+	f.StringVar(&f.config, "config", defaultConfigPath, "path to config file or ptun:// invite")
+	f.StringVar(&f.psk, "psk", "", "pre-shared key")
+	f.StringVar(&f.stateDir, "state-dir", "", "directory for credentials and runtime state")
+	return f
+}
+
+// parse parses args, loads the config they point at and sets up logging
+// as it says.
+func (f *commandFlags) parse(args []string) Config {
+	f.Parse(args)
+	cfg, err := f.reload()
+	if err != nil {
+		fatal("reading config failed", err)
+	}
+	if err := configureLogging(cfg); err != nil {
+		fatal("invalid config", err)
+	}
+	return cfg
+}
+
+// reload reads the config again, with the flags parse was given.
+func (f *commandFlags) reload() (Config, error) {
+	cfg, err := readConfig(f.config, f.listen, f.psk)
+	if f.stateDir != "" {
+		cfg.StateDir = f.stateDir
+	}
+	return cfg, err
+}
+
+// requireFCM exits unless cfg has what registering with FCM needs.
+func requireFCM(cfg Config) {
+	if !cfg.hasFCM() {
+		fmt.Fprintln(os.Stderr, "config needs firebase_credentials, firebase_project and sender_id")
+		os.Exit(1)
+	}
+}
+
+// newFCMSender creates the FCM sender for the configured service account.
+func newFCMSender(cfg Config) (*FCMSender, error) {
+	if len(cfg.fcmCredsJSON) > 0 {
+		return NewFCMSenderJSON(cfg.fcmCredsJSON, cfg.Project)
+	}
+	return NewFCMSender(cfg.FCMCreds, cfg.Project)
+}
+
+// openIdentities locks each of the configured GCM identities and loads its
+// credentials, registering it if needed, or anew if fresh is set. Closing
+// the returned closer releases the locks.
+func openIdentities(cfg Config, state StateDir, fresh bool) ([]*GCMCredentials, io.Closer, error) {
+	if err := state.Create(); err != nil {
+		return nil, nil, err
+	}
+	var locks []*os.File
+	release := closerFunc(func() error {
+		for _, l := range locks {
+			l.Close()
+		}
+		return nil
+	})
+	allCreds := make([]*GCMCredentials, max(cfg.Identities, 1))
+	for i := range allCreds {
+		lock, err := state.Lock(instancePath(credsFile, i))
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("identity %d: %w", i, err)
+		}
+		locks = append(locks, lock)
+		register := RegisterGCM
+		if fresh {
+			register = ReregisterGCM
+		}
+		if allCreds[i], err = register(cfg.SenderID, cfg.credStore(state, i)); err != nil {
+			release()
+			return nil, nil, fmt.Errorf("identity %d: %w", i, err)
+		}
+	}
+	return allCreds, release, nil
+}
+
+func runServe(args []string) {
+	f := newCommandFlags("serve")
+	f.StringVar(&f.listen, "listen", ":8080", "listen address")
+	serve(f.parse(args), f.reload)
+}
+
+// runRegister implements the register command: it checks in and registers
+// each identity that is not registered yet (or all of them with -force) and
+// prints their FCM tokens, one per line.
+func runRegister(args []string) {
+	f := newCommandFlags("register")
+	force := f.Bool("force", false, "discard the existing identities and register new ones")
+	cfg := f.parse(args)
+	requireFCM(cfg)
+
+	allCreds, locks, err := openIdentities(cfg, StateDir(cfg.StateDir), *force)
+	if err != nil {
+		fatal("registering failed", err)
+	}
+	defer locks.Close()
+	if cfg.WebPush {
+		wp, err := NewWebPushSender(cfg.PSK)
+		if err != nil {
+			fatal("webpush init failed", err)
+		}
+		if err := RegisterWebPush(allCreds[0], wp.PublicKey()); err != nil {
+			fatal("registering failed", err)
+		}
+	}
+	for _, c := range allCreds {
+		fmt.Println(c.FCMToken)
+	}
+}
+
+// runToken implements the token command: it prints the FCM tokens of the
+// registered identities, one per line, without touching the network.
+func runToken(args []string) {
+	f := newCommandFlags("token")
+	webPush := f.Bool("webpush", false, "print the web push token instead")
+	cfg := f.parse(args)
+
+	state := StateDir(cfg.StateDir)
+	for i := 0; i < max(cfg.Identities, 1); i++ {
+		creds, err := loadCredentials(cfg.credStore(state, i))
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "identity %d is not registered; run register first\n", i)
+			os.Exit(1)
+		}
+		if err != nil {
+			fatal("reading credentials failed", err)
+		}
+		if *webPush {
+			if i == 0 {
+				fmt.Println(creds.WebPushToken)
+			}
+			continue
+		}
+		fmt.Println(creds.FCMToken)
+	}
+}
+
+// runSelfTest implements the selftest command: it connects each identity to
+// MCS, sends encrypted probe frames of several sizes to them and waits for
+// the probes to be delivered intact. It prints the latency per probe and
+// exits non-zero if any probe did not arrive. The relay must not be running, as it holds the
+// identities; query it with status instead.
+func runSelfTest(args []string) {
+	f := newCommandFlags("selftest")
+	timeout := f.Duration("timeout", selfTestTimeout, "how long to wait for each probe")
+	cfg := f.parse(args)
+	requireFCM(cfg)
+
+	state := StateDir(cfg.StateDir)
+	allCreds, locks, err := openIdentities(cfg, state, false)
+	if err != nil {
+		fatal("opening identities failed (if the relay is running, use status)", err)
+	}
+	defer locks.Close()
+	sender, err := newFCMSender(cfg)
+	if err != nil {
+		fatal("fcm sender init failed", err)
+	}
+	crypto, err := NewCrypto(cfg.PSK)
+	if err != nil {
+		fatal("crypto init failed", err)
+	}
+	codec, err := CodecByName(cfg.PayloadCodec)
+	if err != nil {
+		fatal("invalid config", err)
+	}
+	transport := NewFCMTransport(crypto, sender, cfg.Project, "", nil)
+	transport.SetCodec(codec, cfg.DataKeys)
+	selfTest := NewSelfTest(transport)
+
+	var tokens []string
+	for i, c := range allCreds {
+		mcs := NewMCSClient(c.AndroidID, c.SecurityToken, transport.HandleMCSMessage)
+		mcs.SetLogger(mcsLog.With("identity", i))
+		seenIDs, err := OpenPersistentIDStore(state.Path(instancePath(persistentIDsFile, i)))
+		if err != nil {
+			fatal("opening MCS state failed", err)
+		}
+		mcs.SetPersistentIDStore(seenIDs)
+		mcs.Start()
+		defer mcs.Stop()
+		if !waitLoggedIn(mcs, *timeout) {
+			fmt.Printf("identity %d: MCS login timed out\n", i)
+			os.Exit(1)
+		}
+		tokens = append(tokens, c.FCMToken)
+	}
+
+	result := selfTest.Run(tokens, *timeout)
+	printSelfTest(result)
+	if !result.Passed {
+		os.Exit(1)
+	}
+}
+
+func printSelfTest(r *SelfTestResult) {
+	verdict := "PASS"
+	if !r.Passed {
+		verdict = "FAIL"
+	}
+	fmt.Printf("self-test: %s (%s ago)\n", verdict, time.Since(r.At).Round(time.Second))
+	for _, p := range r.Probes {
+		fmt.Printf("  %6d bytes in %d message(s): ", p.Size, p.Messages)
+		if p.Error != "" {
+			fmt.Println(p.Error)
+		} else {
+			fmt.Println(p.Latency.Round(time.Millisecond))
+		}
+	}
+}
+
+// runStatus implements the status command: it asks the relay running with
+// the same state directory for its status. It exits non-zero if no relay
+// answers, or if none of its identities is logged in to MCS.
+func runStatus(args []string) {
+	f := newCommandFlags("status")
+	asJSON := f.Bool("json", false, "print the raw status as JSON")
+	cfg := f.parse(args)
+
+	status, err := queryStatus(StateDir(cfg.StateDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %v\n", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+	} else {
+		printStatus(status)
+	}
+
+	up := len(status.Identities) == 0 // nothing to be down without FCM
+	for _, id := range status.Identities {
+		if id.State == MCSLoggedIn.String() {
+			up = true
+		}
+	}
+	if !up {
+		os.Exit(1)
+	}
+}
+
+func printStatus(status *RelayStatus) {
+	fmt.Printf("up %s (since %s)\n", time.Since(status.Started).Round(time.Second), status.Started.Format(time.RFC3339))
+	for i, id := range status.Identities {
+		fmt.Printf("identity %d: %s, token %s…, %d reconnect(s), %d unacked", i, id.State, truncate(id.FCMToken, 20), id.Reconnects, id.Unacked)
+		if !id.LastMessage.IsZero() {
+			fmt.Printf(", last message %s ago", time.Since(id.LastMessage).Round(time.Second))
+		}
+		fmt.Println()
+	}
+	for _, p := range status.Peers {
+		fmt.Printf("peer %s: %d token(s), %d channel(s)\n", p.Session, p.PeerTokens, p.Channels)
+	}
+	if status.SelfTest != nil {
+		printSelfTest(status.SelfTest)
+	}
+}
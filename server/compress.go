@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Per-message flags carried in the "f" data key of every FCM message.
+const (
+	// flagCompressed marks a payload that was DEFLATE-compressed before
+	// encryption.
+	flagCompressed = 0x01
+	// flagAcceptCompress advertises that the sender can decompress, so the
+	// peer may start compressing frames it sends back.
+	flagAcceptCompress = 0x02
+)
+
+// compressDict primes DEFLATE with strings common in tunnelled HTTP traffic
+// so that even small frames compress. Must match the client byte for byte.
+const compressDict = "HTTP/1.1 200 OK\r\nHTTP/1.1 301 Moved Permanently\r\nHTTP/1.1 304 Not Modified\r\n" +
+	"GET / HTTP/1.1\r\nPOST / HTTP/1.1\r\nHost: \r\nUser-Agent: Mozilla/5.0 \r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\nAccept-Language: en-US,en;q=0.9\r\n" +
+	"Connection: keep-alive\r\nContent-Type: text/html; charset=utf-8\r\n" +
+	"Content-Type: application/json\r\nContent-Length: \r\nTransfer-Encoding: chunked\r\n" +
+	"Cache-Control: no-cache\r\nCookie: \r\nSet-Cookie: \r\nDate: \r\nServer: \r\n" +
+	"Location: https://\r\nLast-Modified: \r\nETag: \r\nVary: Accept-Encoding\r\n\r\n" +
+	"<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title></title>" +
+	"<script src=\"\"></script><link rel=\"stylesheet\" href=\"\"></head><body><div class=\"\"></div></body></html>"
+
+// compressPayload DEFLATE-compresses data with the shared dictionary.
+// ok is false when compression would not make the payload smaller, in which
+// case the caller should send data unchanged.
+func compressPayload(data []byte) (out []byte, ok bool) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, []byte(compressDict))
+	if err != nil {
+		return nil, false
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressPayload reverses compressPayload. Output is capped at limit bytes
+// so a malicious peer cannot inflate a small message into unbounded memory.
+func decompressPayload(data []byte, limit int) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), []byte(compressDict))
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("inflated payload exceeds %d bytes", limit)
+	}
+	return out, nil
+}
+
+// parseFlags reads the "f" data key; a missing or malformed value means no flags.
+func parseFlags(s string) int {
+	if s == "" {
+		return 0
+	}
+	f, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return f
+}
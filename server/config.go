@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// defaultConfigPath is read when -config is not given. Unlike a path given
+// explicitly it may be missing, for a relay configured by flags and
+// environment alone.
+const defaultConfigPath = "config.json"
+
+// envPrefix prefixes the environment variables overriding config fields:
+// PTUN_PSK for psk, PTUN_PEER_FCM_TOKENS (comma-separated) for
+// peer_fcm_tokens, and so on.
+const envPrefix = "PTUN_"
+
+// minPSKLength is the shortest PSK accepted.
+const minPSKLength = 16
+
+// examplePSKs are the placeholders from the README and example config.
+var examplePSKs = []string{"change-me-to-a-strong-random-secret", "your-strong-shared-secret"}
+
+// applyEnv overrides the fields of cfg whose variable is set in the
+// environment.
+func applyEnv(cfg *Config) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || !field.IsExported() {
+			continue
+		}
+		env := envPrefix + strings.ToUpper(name)
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("%s: want true or false, got %q", env, val)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s: want a number, got %q", env, val)
+			}
+			f.SetInt(int64(n))
+		case reflect.Slice:
+			var list []string
+			for _, s := range strings.Split(val, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+		}
+	}
+	return nil
+}
+
+// validate checks cfg for what the relay cannot run with. The returned
+// warnings point out settings that work but are probably not intended.
+func (c Config) validate() (warnings []string, err error) {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case c.PSK == "":
+		fail("psk is required")
+	case len(c.PSK) < minPSKLength:
+		fail("psk is too weak: use at least %d characters, e.g. from `openssl rand -base64 32`", minPSKLength)
+	default:
+		for _, example := range examplePSKs {
+			if c.PSK == example {
+				fail("psk is still the example value; generate one, e.g. with `openssl rand -base64 32`")
+			}
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		fail("listen_addr: %v", err)
+	}
+	if c.AdminAddr != "" {
+		// The session routes show every target and can close channels, and
+		// even a loopback address is open to every local user.
+		_, _, err := net.SplitHostPort(c.AdminAddr)
+		switch {
+		case err != nil:
+			fail("admin_addr: %v", err)
+		case c.AdminAddr == c.ListenAddr:
+			fail("admin_addr must differ from listen_addr")
+		case c.AdminToken == "":
+			fail("admin_addr is set but admin_token is not; generate one, e.g. with `openssl rand -base64 32`")
+		}
+	} else if c.AdminToken != "" {
+		fail("admin_token is set but admin_addr is not")
+	}
+
+	// FCM needs the service account key, its project and the sender ID
+	// together; with only some of them it would be silently disabled.
+	hasCreds := c.FCMCreds != "" || len(c.fcmCredsJSON) > 0
+	switch {
+	case hasCreds && c.SenderID == "":
+		fail("firebase_credentials is set but sender_id is not")
+	case !hasCreds && c.SenderID != "":
+		fail("sender_id is set but firebase_credentials is not")
+	case !hasCreds && c.Project != "":
+		fail("firebase_project is set but firebase_credentials is not")
+	}
+	if hasCreds {
+		if c.Project == "" {
+			fail("firebase_credentials is set but firebase_project is not")
+		}
+		if err := checkServiceAccount(c); err != nil {
+			fail("firebase_credentials: %v", err)
+		}
+	}
+
+	if c.WebPush && !c.hasFCM() {
+		fail("webpush needs firebase_credentials and sender_id")
+	}
+	if c.PeerWebPushToken != "" && !c.WebPush {
+		fail("peer_webpush_token is set but webpush is not enabled")
+	}
+	for i, t := range c.PeerFCMTokens {
+		if strings.TrimSpace(t) == "" {
+			fail("peer_fcm_tokens[%d] is empty", i)
+		}
+	}
+	if c.hasFCM() && len(c.peerTokens()) == 0 {
+		warnings = append(warnings, "no peer_fcm_token: the relay cannot send until the client's HELLO announces one")
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		fail("%v", err)
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		fail("log_format: want text or json, got %q", c.LogFormat)
+	}
+
+	if _, err := CodecByName(c.PayloadCodec); err != nil {
+		fail("payload_codec: %v", err)
+	}
+	for _, f := range []struct {
+		name string
+		n    int
+	}{{"identities", c.Identities}, {"redundancy", c.Redundancy}, {"data_keys", c.DataKeys}} {
+		if f.n < 0 {
+			fail("%s must not be negative", f.name)
+		}
+	}
+	if tokens := len(c.peerTokens()); tokens > 0 && c.Redundancy > tokens {
+		warnings = append(warnings, fmt.Sprintf("redundancy %d exceeds the %d peer token(s); each message goes to every token", c.Redundancy, tokens))
+	}
+
+	return warnings, errors.Join(errs...)
+}
+
+// checkServiceAccount reads and parses the configured service account key.
+func checkServiceAccount(c Config) error {
+	key := c.fcmCredsJSON
+	if len(key) == 0 {
+		var err error
+		if key, err = os.ReadFile(c.FCMCreds); err != nil {
+			return err
+		}
+	}
+	if _, err := google.JWTConfigFromJSON(key); err != nil {
+		return fmt.Errorf("not a service account key: %w", err)
+	}
+	return nil
+}
+
+// runValidate implements the validate command: it reads the config as the
+// relay would and reports every problem in it, exiting 1 if there are any.
+func runValidate(args []string) {
+	f := newCommandFlags("validate")
+	f.StringVar(&f.listen, "listen", ":8080", "listen address")
+	f.Parse(args)
+
+	cfg, err := f.reload()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(1)
+	}
+	warnings, err := cfg.validate()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "error: %s\n", line)
+		}
+		os.Exit(1)
+	}
+	fcm := "disabled"
+	if cfg.hasFCM() {
+		fcm = fmt.Sprintf("project %s, sender %s, %d identity(ies)", cfg.Project, cfg.SenderID, max(cfg.Identities, 1))
+	}
+	fmt.Printf("config OK (FCM: %s)\n", fcm)
+}
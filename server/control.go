@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// controlSocket is the relay's local control socket, in the state directory.
+// Only the relay's own user can reach it.
+const controlSocket = "control.sock"
+
+// RelayStatus is what a running relay reports on its control socket.
+type RelayStatus struct {
+	Started    time.Time        `json:"started"`
+	Identities []IdentityStatus `json:"identities,omitempty"`
+	Peers      []PeerStatus     `json:"peers,omitempty"`
+	SelfTest   *SelfTestResult  `json:"self_test,omitempty"`
+}
+
+// IdentityStatus describes one GCM identity and its MCS connection.
+type IdentityStatus struct {
+	FCMToken    string    `json:"fcm_token"`
+	State       string    `json:"mcs_state"`
+	LastLogin   time.Time `json:"last_login"`
+	LastMessage time.Time `json:"last_message"`
+	Reconnects  int       `json:"reconnects"`
+	Unacked     int       `json:"unacked"`
+}
+
+// PeerStatus describes one FCM peer session.
+type PeerStatus struct {
+	Session    string `json:"session"`
+	PeerTokens int    `json:"peer_tokens"`
+	Channels   int    `json:"channels"`
+}
+
+// serveControl answers status queries, and serves the session routes of the
+// admin listener, on the control socket in state until the returned closer
+// is closed.
+func serveControl(state StateDir, srv *Server) (io.Closer, error) {
+	lock, err := state.Lock(controlSocket)
+	if err != nil {
+		return nil, err
+	}
+	path := state.Path(controlSocket)
+	os.Remove(path) // left behind by a relay that did not exit cleanly
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(srv.Status())
+	})
+	sessionRoutes(mux, srv)
+	go http.Serve(ln, mux)
+	return closerFunc(func() error {
+		ln.Close()
+		return lock.Close()
+	}), nil
+}
+
+// queryStatus asks the relay using state for its status.
+func queryStatus(state StateDir) (*RelayStatus, error) {
+	path := state.Path(controlSocket)
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://relay/status")
+	if err != nil {
+		return nil, fmt.Errorf("no relay running with state in %s: %w", state, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status returned %s", resp.Status)
+	}
+	var status RelayStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -7,23 +7,32 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 
 	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	nonceSize = 12 // AES-GCM standard nonce
 	keySize   = 32 // AES-256
 	hkdfSalt  = "push-tunnel-v1"
+	keyIDInfo = "push-tunnel-key-id"
+
+	// Keys derived from passphrases (invites, stored credentials) use
+	// PBKDF2-SHA256 with a random salt.
+	passphraseKDFIterations = 200000
+	passphraseSaltSize      = 16
 )
 
 // Crypto handles AES-256-GCM encryption with HKDF-derived keys.
 type Crypto struct {
-	aead cipher.AEAD
-	key  []byte
+	aead  cipher.AEAD
+	key   []byte
+	keyID string
 }
 
 // NewCrypto derives an AES-256 key from the PSK using HKDF-SHA256 and
@@ -42,25 +51,31 @@ func NewCrypto(psk string) (*Crypto, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Crypto{aead: aead, key: key}, nil
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(psk), []byte(hkdfSalt), []byte(keyIDInfo)), id); err != nil {
+		return nil, fmt.Errorf("hkdf: %w", err)
+	}
+	return &Crypto{aead: aead, key: key, keyID: hex.EncodeToString(id)}, nil
 }
 
-// Encrypt encrypts plaintext and returns base64(nonce || ciphertext || tag).
-func (c *Crypto) Encrypt(plaintext []byte) (string, error) {
+// KeyID is a short public identifier of the key, sent alongside messages so
+// a relay serving several users knows which key to open them with. It
+// reveals nothing about the key itself.
+func (c *Crypto) KeyID() string {
+	return c.keyID
+}
+
+// Seal encrypts plaintext and returns nonce || ciphertext || tag.
+func (c *Crypto) Seal(plaintext []byte) ([]byte, error) {
 	nonce := make([]byte, nonceSize)
 	if _, err := rand.Read(nonce); err != nil {
-		return "", err
+		return nil, err
 	}
-	ciphertext := c.aead.Seal(nonce, nonce, plaintext, nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
 }
 
-// Decrypt decodes base64 input and decrypts it.
-func (c *Crypto) Decrypt(encoded string) ([]byte, error) {
-	data, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		return nil, fmt.Errorf("base64 decode: %w", err)
-	}
+// Open decrypts data produced by Seal.
+func (c *Crypto) Open(data []byte) ([]byte, error) {
 	if len(data) < nonceSize+c.aead.Overhead() {
 		return nil, errors.New("ciphertext too short")
 	}
@@ -73,6 +88,35 @@ func (c *Crypto) Decrypt(encoded string) ([]byte, error) {
 	return plaintext, nil
 }
 
+// Encrypt encrypts plaintext and returns base64(nonce || ciphertext || tag).
+func (c *Crypto) Encrypt(plaintext []byte) (string, error) {
+	sealed, err := c.Seal(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decodes base64 input and decrypts it.
+func (c *Crypto) Decrypt(encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode: %w", err)
+	}
+	return c.Open(data)
+}
+
+// passphraseAEAD returns AES-256-GCM keyed with PBKDF2-SHA256 over
+// passphrase and salt.
+func passphraseAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, passphraseKDFIterations, keySize, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // ComputeAuthToken generates HMAC-SHA256(deviceID, timestamp) for request auth.
 func ComputeAuthToken(deviceID string, timestamp string, key []byte) string {
 	mac := hmac.New(sha256.New, key)
@@ -3,9 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -16,6 +16,21 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
+// errMessageTooBig is returned (wrapped) by SendData when FCM rejects a
+// message for exceeding its payload size limit.
+var errMessageTooBig = errors.New("fcm: message too big")
+
+// errTokenUnregistered is returned (wrapped) when FCM reports the target
+// token as no longer registered.
+var errTokenUnregistered = errors.New("fcm: token unregistered")
+
+// Other errors FCM answers with, told apart for the send metrics.
+var (
+	errTokenInvalid  = errors.New("fcm: peer token invalid")
+	errQuotaExceeded = errors.New("fcm: quota exceeded")
+	errFCMRejected   = errors.New("fcm")
+)
+
 // FCMSender sends push notifications via the FCM HTTP v1 API.
 // No Firebase Admin SDK — uses raw HTTP with OAuth2 service account auth.
 type FCMSender struct {
@@ -30,7 +45,7 @@ type FCMSender struct {
 // project is the Firebase project ID (e.g. "weatherpulse-12345").
 func NewFCMSender(credFile string, project string) (*FCMSender, error) {
 	if credFile == "" || project == "" {
-		log.Println("[fcm] no credentials/project; FCM sending disabled")
+		fcmLog.Warn("no credentials or project; FCM sending disabled")
 		return &FCMSender{enabled: false}, nil
 	}
 
@@ -38,7 +53,12 @@ func NewFCMSender(credFile string, project string) (*FCMSender, error) {
 	if err != nil {
 		return nil, fmt.Errorf("read service account key: %w", err)
 	}
+	return NewFCMSenderJSON(keyJSON, project)
+}
 
+// NewFCMSenderJSON initialises the FCM sender from service account key JSON,
+// as carried inline by an invite.
+func NewFCMSenderJSON(keyJSON []byte, project string) (*FCMSender, error) {
 	cfg, err := google.JWTConfigFromJSON(keyJSON, "https://www.googleapis.com/auth/firebase.messaging")
 	if err != nil {
 		return nil, fmt.Errorf("parse service account key: %w", err)
@@ -46,7 +66,7 @@ func NewFCMSender(credFile string, project string) (*FCMSender, error) {
 
 	tokenSrc := cfg.TokenSource(oauth2.NoContext)
 
-	log.Printf("[fcm] sender initialised for project %s", project)
+	fcmLog.Info("sender initialised", "project", project)
 	return &FCMSender{
 		project:    project,
 		tokenSrc:   tokenSrc,
@@ -57,10 +77,27 @@ func NewFCMSender(credFile string, project string) (*FCMSender, error) {
 
 // SendData sends an FCM data message with the given key-value data payload.
 func (f *FCMSender) SendData(fcmToken string, data map[string]string) error {
+	return f.send(fcmToken, data, false)
+}
+
+// ValidateToken asks FCM to validate a message to fcmToken without delivering
+// it. It returns an error wrapping errTokenUnregistered if the token is dead.
+func (f *FCMSender) ValidateToken(fcmToken string) error {
+	return f.send(fcmToken, map[string]string{"type": "weather_alert"}, true)
+}
+
+func (f *FCMSender) send(fcmToken string, data map[string]string, validateOnly bool) error {
 	if !f.enabled {
 		return nil
 	}
+	err := f.post(fcmToken, data, validateOnly)
+	if !validateOnly {
+		fcmSends.Inc(sendResult(err))
+	}
+	return err
+}
 
+func (f *FCMSender) post(fcmToken string, data map[string]string, validateOnly bool) error {
 	url := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", f.project)
 
 	payload := map[string]interface{}{
@@ -69,9 +106,16 @@ func (f *FCMSender) SendData(fcmToken string, data map[string]string) error {
 			"data":  data,
 		},
 	}
+	if validateOnly {
+		payload["validate_only"] = true
+	}
 
-	body, err := json.Marshal(payload)
-	if err != nil {
+	// Z85 payloads contain &, < and >, which HTML escaping would inflate
+	// to six bytes each.
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(payload); err != nil {
 		return err
 	}
 
@@ -80,7 +124,7 @@ func (f *FCMSender) SendData(fcmToken string, data map[string]string) error {
 		return fmt.Errorf("oauth2 token: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	req, err := http.NewRequest("POST", url, &body)
 	if err != nil {
 		return err
 	}
@@ -94,15 +138,43 @@ func (f *FCMSender) SendData(fcmToken string, data map[string]string) error {
 	defer resp.Body.Close()
 
 	respBody, _ := io.ReadAll(resp.Body)
-	log.Printf("[fcm] API response %d: %s", resp.StatusCode, string(respBody))
+	fcmLog.Debug("API response", "status", resp.StatusCode, "body", string(respBody))
 
 	if resp.StatusCode != 200 {
 		respStr := string(respBody)
-		if strings.Contains(respStr, "UNREGISTERED") || strings.Contains(respStr, "INVALID_ARGUMENT") {
-			return fmt.Errorf("fcm: peer token invalid (%d): %s", resp.StatusCode, respStr)
+		if strings.Contains(respStr, "too big") {
+			return fmt.Errorf("%w (%d): %s", errMessageTooBig, resp.StatusCode, respStr)
+		}
+		if strings.Contains(respStr, "UNREGISTERED") {
+			return fmt.Errorf("%w (%d): %s", errTokenUnregistered, resp.StatusCode, respStr)
+		}
+		if strings.Contains(respStr, "INVALID_ARGUMENT") {
+			return fmt.Errorf("%w (%d): %s", errTokenInvalid, resp.StatusCode, respStr)
 		}
-		return fmt.Errorf("fcm: %d: %s", resp.StatusCode, respStr)
+		if resp.StatusCode == http.StatusTooManyRequests || strings.Contains(respStr, "QUOTA_EXCEEDED") {
+			return fmt.Errorf("%w (%d): %s", errQuotaExceeded, resp.StatusCode, respStr)
+		}
+		return fmt.Errorf("%w: %d: %s", errFCMRejected, resp.StatusCode, respStr)
 	}
 
 	return nil
 }
+
+// sendResult classifies the outcome of an FCM or web push send.
+func sendResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, errTokenUnregistered):
+		return "unregistered"
+	case errors.Is(err, errTokenInvalid):
+		return "invalid_token"
+	case errors.Is(err, errMessageTooBig):
+		return "too_big"
+	case errors.Is(err, errQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, errFCMRejected), errors.Is(err, errWebPushRejected):
+		return "rejected"
+	}
+	return "error"
+}
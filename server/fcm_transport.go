@@ -2,64 +2,256 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// FCM data messages max ~4KB. With JSON overhead, ~3KB usable per chunk.
+	// This is the default; ProbeChunkSize can tune it per deployment.
 	maxChunkDataSize = 3072
 	// Maximum frame size before chunking.
 	maxFrameSize = 32 * 1024
 	// Timeout for chunk reassembly.
 	chunkTimeout = 30 * time.Second
+
+	// Bounds and precision for ProbeChunkSize's binary search, and the room
+	// left for the mid/ci/ct/f/e/dN keys that real messages carry.
+	probeMinSize   = 1024
+	probeMaxSize   = 8192
+	probePrecision = 32
+	probeMargin    = 96
+
+	// probeMessageType marks ProbeChunkSize's filler messages.
+	probeMessageType = "probe"
 )
 
 // FCMTransport orchestrates sending frames via the FCM HTTP v1 API and
 // receiving frames via the MCS client. Handles chunking for large frames.
 type FCMTransport struct {
-	crypto  *Crypto
-	sender  *FCMSender
-	mcs     *MCSClient
-	creds   *GCMCredentials
+	// settingsMu guards the settings a config reload may change: crypto,
+	// redundancy, compress, codec and dataKeys.
+	settingsMu sync.RWMutex
+
+	crypto *Crypto
+	sender *FCMSender
+	mcs    []*MCSClient    // one per identity, all feeding HandleMCSMessage
+	creds  *GCMCredentials // primary identity
 
-	peerToken string // the other side's FCM token
-	project   string // Firebase project ID
+	// The other side's FCM tokens. Messages are spread round-robin over
+	// them, with redundancy copies of each sent to distinct tokens.
+	peerMu     sync.RWMutex
+	peerTokens []string
+	redundancy int
+	rr         atomic.Uint64
+
+	project string // Firebase project ID
 
 	onFrame func(Frame) // callback for received frames
+	onProbe func(Frame) // callback for received FrameProbe frames
+
+	// Compression negotiation: we compress outgoing frames only when enabled
+	// locally and the peer has advertised flagAcceptCompress.
+	compress     bool
+	peerCompress atomic.Bool
+
+	// Payload encoding. codec is only used once the peer has advertised
+	// flagAcceptCodecs; until then we fall back to plain base64 in "d".
+	codec      PayloadCodec
+	dataKeys   int
+	peerCodecs atomic.Bool
+	chunkSize  atomic.Int64
+
+	// Binary send path; nil unless web push is configured.
+	webPush          *WebPushSender
+	peerWebPushToken string
+
+	// Recently received payload digests, for dropping copies that arrive
+	// via more than one of our identities.
+	recent *recentSet
+
+	// Messages sent to and received from the peer, and the session they
+	// are traced under.
+	usage   *Usage
+	session string
 
 	// Chunk reassembly state.
 	chunkMu     sync.Mutex
 	chunkBuffer map[string]*chunkGroup
 }
 
+// recentDedupSize is how many payload digests we remember for dedup.
+const recentDedupSize = 4096
+
+// recentSet remembers the last n keys added.
+type recentSet struct {
+	mu   sync.Mutex
+	ring []string
+	next int
+	set  map[string]struct{}
+}
+
+func newRecentSet(n int) *recentSet {
+	return &recentSet{ring: make([]string, n), set: make(map[string]struct{}, n)}
+}
+
+// Add records key and reports whether it was new.
+func (r *recentSet) Add(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.set[key]; ok {
+		return false
+	}
+	if old := r.ring[r.next]; old != "" {
+		delete(r.set, old)
+	}
+	r.ring[r.next] = key
+	r.next = (r.next + 1) % len(r.ring)
+	r.set[key] = struct{}{}
+	return true
+}
+
 // chunkGroup tracks received chunks for a single message.
 type chunkGroup struct {
 	total    int
+	flags    int
+	codec    string
 	chunks   map[int][]byte
 	received time.Time
 }
 
 // NewFCMTransport creates a new FCM transport.
 func NewFCMTransport(crypto *Crypto, sender *FCMSender, project string, peerToken string, onFrame func(Frame)) *FCMTransport {
-	return &FCMTransport{
+	t := &FCMTransport{
 		crypto:      crypto,
 		sender:      sender,
 		project:     project,
-		peerToken:   peerToken,
+		redundancy:  1,
 		onFrame:     onFrame,
+		recent:      newRecentSet(recentDedupSize),
+		codec:       base64Codec{},
+		dataKeys:    1,
+		usage:       &Usage{},
 		chunkBuffer: make(map[string]*chunkGroup),
 	}
+	if peerToken != "" {
+		t.peerTokens = []string{peerToken}
+	}
+	t.chunkSize.Store(maxChunkDataSize)
+	return t
+}
+
+// AddMCS registers an MCS client (one per identity) as a receive path.
+// Must be called before the clients start.
+func (t *FCMTransport) AddMCS(mcs *MCSClient) {
+	t.mcs = append(t.mcs, mcs)
+	mcs.OnStateChange(func(state MCSState) {
+		if state == MCSDisconnected {
+			fcmLog.Warn("receive path down; pushes to it are queued by FCM until MCS reconnects", "up", t.receivePathsUp(), "paths", len(t.mcs))
+		} else if state == MCSLoggedIn {
+			fcmLog.Info("receive path up", "up", t.receivePathsUp(), "paths", len(t.mcs))
+		}
+	})
+}
+
+func (t *FCMTransport) receivePathsUp() int {
+	up := 0
+	for _, m := range t.mcs {
+		if m.State() == MCSLoggedIn {
+			up++
+		}
+	}
+	return up
+}
+
+// SetPeerTokens replaces the peer's FCM tokens.
+func (t *FCMTransport) SetPeerTokens(tokens []string) {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	t.peerTokens = append([]string(nil), tokens...)
+}
+
+// PeerTokens returns the peer's FCM tokens.
+func (t *FCMTransport) PeerTokens() []string {
+	t.peerMu.RLock()
+	defer t.peerMu.RUnlock()
+	return append([]string(nil), t.peerTokens...)
+}
+
+// SetRedundancy sets how many distinct peer tokens each message is sent to.
+func (t *FCMTransport) SetRedundancy(n int) {
+	if n < 1 {
+		n = 1
+	}
+	t.settingsMu.Lock()
+	defer t.settingsMu.Unlock()
+	t.redundancy = n
+}
+
+// SetCrypto replaces the key frames are sealed and opened with.
+func (t *FCMTransport) SetCrypto(c *Crypto) {
+	t.settingsMu.Lock()
+	defer t.settingsMu.Unlock()
+	t.crypto = c
+}
+
+// Crypto returns the key frames are sealed and opened with.
+func (t *FCMTransport) Crypto() *Crypto {
+	t.settingsMu.RLock()
+	defer t.settingsMu.RUnlock()
+	return t.crypto
+}
+
+// sendData sends one FCM message to the peer. Successive messages rotate
+// through the peer's tokens; with redundancy > 1 copies go to the next
+// tokens too and the call succeeds if any copy was accepted.
+func (t *FCMTransport) sendData(data map[string]string) error {
+	tokens := t.PeerTokens()
+	if len(tokens) == 0 {
+		return errors.New("no peer FCM token")
+	}
+	t.settingsMu.RLock()
+	n := t.redundancy
+	t.settingsMu.RUnlock()
+	if n > len(tokens) {
+		n = len(tokens)
+	}
+	start := int(t.rr.Add(1) % uint64(len(tokens)))
+
+	var firstErr error
+	sent := false
+	for i := 0; i < n; i++ {
+		if err := t.sender.SendData(tokens[(start+i)%len(tokens)], data); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent = true
+		t.usage.messagesSent.Add(1)
+	}
+	if sent {
+		return nil
+	}
+	return firstErr
+}
+
+// SetUsage sets where the messages sent and received are counted.
+func (t *FCMTransport) SetUsage(u *Usage) {
+	t.usage = u
 }
 
-// SetMCS sets the MCS client reference (for receiving).
-func (t *FCMTransport) SetMCS(mcs *MCSClient) {
-	t.mcs = mcs
+// SetSession names the session the transport serves, in the trace.
+func (t *FCMTransport) SetSession(sessionID string) {
+	t.session = sessionID
 }
 
 // SetCredentials stores our own GCM credentials.
@@ -67,91 +259,307 @@ func (t *FCMTransport) SetCredentials(creds *GCMCredentials) {
 	t.creds = creds
 }
 
+// SetCompression enables or disables compression of outgoing frames. When
+// enabled we also advertise to the peer that we accept compressed frames.
+func (t *FCMTransport) SetCompression(enabled bool) {
+	t.settingsMu.Lock()
+	defer t.settingsMu.Unlock()
+	t.compress = enabled
+}
+
+// SetCodec selects the payload codec and how many data keys each message's
+// payload is spread across. Both only take effect once the peer accepts them.
+func (t *FCMTransport) SetCodec(codec PayloadCodec, dataKeys int) {
+	if dataKeys < 1 {
+		dataKeys = 1
+	}
+	t.settingsMu.Lock()
+	defer t.settingsMu.Unlock()
+	t.codec = codec
+	t.dataKeys = dataKeys
+}
+
+// SetWebPush enables sending frames as binary web push payloads to the
+// peer's web push token.
+func (t *FCMTransport) SetWebPush(wp *WebPushSender, peerToken string) {
+	t.webPush = wp
+	t.SetPeerWebPushToken(peerToken)
+}
+
+// SetPeerWebPushToken replaces the peer's web push token.
+func (t *FCMTransport) SetPeerWebPushToken(token string) {
+	t.peerMu.Lock()
+	defer t.peerMu.Unlock()
+	t.peerWebPushToken = token
+}
+
+// PeerWebPushToken returns the peer's web push token, if known.
+func (t *FCMTransport) PeerWebPushToken() string {
+	t.peerMu.RLock()
+	defer t.peerMu.RUnlock()
+	return t.peerWebPushToken
+}
+
+// SetChunkSize sets the number of encoded payload bytes carried per message.
+func (t *FCMTransport) SetChunkSize(n int) {
+	t.chunkSize.Store(int64(n))
+}
+
+// ChunkSize returns the current number of payload bytes per message.
+func (t *FCMTransport) ChunkSize() int {
+	return int(t.chunkSize.Load())
+}
+
 // SendFrame encrypts and sends a frame to the peer via FCM.
 // Large frames are chunked into multiple FCM messages.
 func (t *FCMTransport) SendFrame(frame Frame) error {
-	log.Printf("[fcm-transport] sending frame type=%d ch=%d len=%d", frame.Type, frame.ChannelID, len(frame.Payload))
+	fcmLog.Debug("sending frame", "type", frameTypeName(frame.Type), "channel", frame.ChannelID, "len", len(frame.Payload))
+	_, err := t.sendFrame(frame, false, t.sendData)
+	return err
+}
+
+// SendProbe sends frame to one of our own tokens as data messages, chunked
+// like any other frame, and returns how many messages it took. Probes
+// advertise no capabilities, so receiving them does not change what we
+// believe the peer accepts.
+func (t *FCMTransport) SendProbe(token string, frame Frame) (int, error) {
+	return t.sendFrame(frame, true, func(data map[string]string) error {
+		return t.sender.SendData(token, data)
+	})
+}
+
+// SetProbeHandler sets the callback for received FrameProbe frames.
+func (t *FCMTransport) SetProbeHandler(fn func(Frame)) {
+	t.onProbe = fn
+}
+
+// sendFrame seals frame and sends it with send, chunking as needed. It
+// returns the number of data messages sent.
+func (t *FCMTransport) sendFrame(frame Frame, probe bool, send func(map[string]string) error) (int, error) {
 	raw, err := EncodeFrame(frame)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	encrypted, err := t.crypto.Encrypt(raw)
+	t.settingsMu.RLock()
+	crypto, compress, peerCodec, peerDataKeys := t.crypto, t.compress, t.codec, t.dataKeys
+	t.settingsMu.RUnlock()
+
+	flags := 0
+	if compress && !probe {
+		flags |= flagAcceptCompress
+		if t.peerCompress.Load() {
+			if packed, ok := compressPayload(raw); ok {
+				raw = packed
+				flags |= flagCompressed
+			}
+		}
+	}
+
+	if !probe {
+		flags |= flagAcceptCodecs
+	}
+
+	sealed, err := crypto.Seal(raw)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	framesSent.Inc(frameTypeName(frame.Type))
+	frameBytesSent.Add(float64(len(sealed)))
+	// The frame is traced with the ID of the message(s) carrying it, so
+	// decode can tell which channel a message belonged to.
+	ev := TraceEvent{Dir: "send", Event: traceFrame, Frame: frameTypeName(frame.Type), Channel: frame.ChannelID, Len: len(frame.Payload), Size: len(sealed), Flags: flags}
+
+	if !probe && t.webPush != nil && t.PeerWebPushToken() != "" {
+		var mid [8]byte
+		rand.Read(mid[:])
+		ev.MID = rawMessageID(mid)
+		t.traceEvent(ev)
+		return 0, t.sendRaw(sealed, flags, mid)
 	}
 
-	encBytes := []byte(encrypted)
+	codec, dataKeys := PayloadCodec(base64Codec{}), 1
+	if t.peerCodecs.Load() {
+		codec, dataKeys = peerCodec, peerDataKeys
+	}
+	encoded := codec.Encode(sealed)
+	chunkSize := t.ChunkSize()
 
-	if len(encBytes) <= maxChunkDataSize {
+	newData := func() map[string]string {
+		data := map[string]string{"type": "weather_alert"}
+		if flags != 0 {
+			data["f"] = strconv.Itoa(flags)
+		}
+		if id := codec.ID(); id != "" {
+			data["e"] = id
+		}
+		return data
+	}
+
+	if len(encoded) <= chunkSize {
 		// Single message, no chunking needed.
-		err := t.sender.SendData(t.peerToken, map[string]string{
-			"type": "weather_alert",
-			"d":    encrypted,
-		})
+		data := newData()
+		putPayload(data, encoded, dataKeys)
+		ev.MID = messageID(data)
+		t.traceEvent(ev)
+		err := send(data)
+		t.traceSent("data", ev.MID, nil, len(encoded), err)
 		if err != nil {
-			log.Printf("[fcm-transport] send error: %v", err)
+			fcmLog.Warn("send failed", sensitiveErrAttr(err))
 		}
-		return err
+		return 1, err
 	}
 
-	// Chunk the encrypted data.
+	// Chunk the encoded data.
 	mid := randomMessageID()
-	chunks := splitBytes(encBytes, maxChunkDataSize)
+	chunks := splitBytes([]byte(encoded), chunkSize)
 	ct := strconv.Itoa(len(chunks))
+	ev.MID = mid
+	t.traceEvent(ev)
 
 	for i, chunk := range chunks {
-		data := map[string]string{
-			"type": "weather_alert",
-			"mid":  mid,
-			"ci":   strconv.Itoa(i),
-			"ct":   ct,
-			"d":    string(chunk),
-		}
-		if err := t.sender.SendData(t.peerToken, data); err != nil {
-			return fmt.Errorf("send chunk %d/%s: %w", i, ct, err)
+		data := newData()
+		data["mid"] = mid
+		data["ci"] = strconv.Itoa(i)
+		data["ct"] = ct
+		putPayload(data, string(chunk), dataKeys)
+		err := send(data)
+		t.traceSent("data", mid, []int{i, len(chunks)}, len(chunk), err)
+		if err != nil {
+			return i, fmt.Errorf("send chunk %d/%s: %w", i, ct, err)
 		}
 	}
 
+	return len(chunks), nil
+}
+
+// sendRaw delivers sealed bytes through web push, chunking them across as
+// many pushes as needed. Used instead of data messages once the peer's web
+// push token is known, saving the base64 expansion. mid identifies the
+// pushes of one frame.
+func (t *FCMTransport) sendRaw(sealed []byte, flags int, mid [8]byte) error {
+	token := t.PeerWebPushToken()
+	chunks := splitBytes(sealed, maxRawChunkDataLen)
+	env := rawEnvelope{flags: byte(flags), count: byte(len(chunks)), mid: mid}
+
+	for i, chunk := range chunks {
+		env.index = byte(i)
+		body := wrapRFC8188(encodeRawEnvelope(env, chunk))
+		err := t.webPush.SendRaw(token, body)
+		var pos []int
+		if len(chunks) > 1 {
+			pos = []int{i, len(chunks)}
+		}
+		t.traceSent("raw", rawMessageID(mid), pos, len(body), err)
+		if err != nil {
+			return fmt.Errorf("send raw chunk %d/%d: %w", i, len(chunks), err)
+		}
+		t.usage.messagesSent.Add(1)
+	}
 	return nil
 }
 
 // HandleMCSMessage processes an incoming MCS DataMessage.
 // Called by the MCS client's onMessage callback.
 func (t *FCMTransport) HandleMCSMessage(dm *DataMessage) {
-	log.Printf("[fcm-transport] received MCS message from=%s category=%s fields=%d", dm.From, dm.Category, len(dm.AppDataList))
+	fcmLog.Debug("received MCS message", "from", dm.From, "category", dm.Category, "fields", len(dm.AppDataList))
 	data := make(map[string]string)
 	for _, kv := range dm.AppDataList {
 		data[kv.Key] = kv.Value
 	}
+	if data["type"] == probeMessageType {
+		// Our own chunk size probe; it carries nothing and all look alike.
+		return
+	}
+
+	// With several identities the peer may send copies of a message to more
+	// than one of them; the ciphertext (random nonce) identifies a message.
+	var digest [sha256.Size]byte
+	if len(dm.RawData) > 0 {
+		digest = sha256.Sum256(dm.RawData)
+	} else {
+		digest = sha256.Sum256([]byte(data["mid"] + "/" + data["ci"] + "/" + joinPayload(data)))
+	}
+	if !t.recent.Add(string(digest[:16])) {
+		fcmLog.Debug("dropping duplicate message", "from", dm.From)
+		duplicatesDropped.Inc()
+		// Finding a web push's ID means unwrapping it; only do so for the trace.
+		if !trace.Enabled() {
+			return
+		}
+		if len(dm.RawData) > 0 {
+			mid, pos := rawTracePosition(dm.RawData)
+			t.traceEvent(TraceEvent{Dir: "recv", Event: traceDuplicate, Path: "raw", MID: mid, Chunk: pos, Size: len(dm.RawData)})
+		} else {
+			t.traceEvent(TraceEvent{Dir: "recv", Event: traceDuplicate, Path: "data", MID: messageID(data), Chunk: chunkPosition(data), Size: len(joinPayload(data))})
+		}
+		return
+	}
+	t.usage.messagesReceived.Add(1)
+
+	if len(dm.RawData) > 0 {
+		messagesReceived.Inc("raw")
+		t.handleRaw(dm)
+		return
+	}
+	messagesReceived.Inc("data")
+
+	flags := parseFlags(data["f"])
+	mid := messageID(data)
+	t.traceEvent(TraceEvent{Dir: "recv", Event: traceMessage, Path: "data", MID: mid, Chunk: chunkPosition(data), Size: len(joinPayload(data)), Flags: flags})
+	t.notePeerFlags(flags)
 
 	// Check if this is a chunked message.
-	mid := data["mid"]
-	if mid != "" {
+	if data["mid"] != "" {
 		t.handleChunked(data)
 		return
 	}
 
 	// Single (non-chunked) message.
-	encrypted := data["d"]
-	if encrypted == "" {
+	encoded := joinPayload(data)
+	if encoded == "" {
 		return
 	}
 
-	t.decryptAndDeliver(encrypted)
+	t.decryptAndDeliver(encoded, data["e"], flags, mid)
+}
+
+// notePeerFlags records the capabilities a peer advertises in its messages.
+func (t *FCMTransport) notePeerFlags(flags int) {
+	t.settingsMu.RLock()
+	defer t.settingsMu.RUnlock()
+	if flags&flagAcceptCompress != 0 && t.compress && !t.peerCompress.Swap(true) {
+		fcmLog.Info("peer accepts compression; enabling")
+	}
+	if flags&flagAcceptCodecs != 0 && !t.peerCodecs.Swap(true) {
+		fcmLog.Info("peer accepts payload codecs", "codec", t.codec.ID(), "data_keys", t.dataKeys)
+	}
 }
 
 func (t *FCMTransport) handleChunked(data map[string]string) {
 	mid := data["mid"]
 	ci, _ := strconv.Atoi(data["ci"])
 	ct, _ := strconv.Atoi(data["ct"])
-	chunk := data["d"]
+	chunk := joinPayload(data)
 
 	if ct <= 0 || ci < 0 || ci >= ct || chunk == "" {
-		log.Printf("[fcm-transport] invalid chunk: mid=%s ci=%d ct=%d", mid, ci, ct)
+		fcmLog.Warn("invalid chunk", "mid", mid, "ci", ci, "ct", ct)
+		t.receiveFailed("invalid_chunk")
 		return
 	}
 
+	group, assembled := t.collectChunk(mid, ci, ct, parseFlags(data["f"]), data["e"], []byte(chunk))
+	if assembled == nil {
+		return
+	}
+
+	t.decryptAndDeliver(string(assembled), group.codec, group.flags, mid)
+}
+
+// collectChunk stores one chunk of message mid and, once every chunk has
+// arrived, removes the group and returns it with the concatenated payload.
+// flags and codec are recorded from whichever chunk arrives first.
+func (t *FCMTransport) collectChunk(mid string, ci, ct, flags int, codec string, chunk []byte) (*chunkGroup, []byte) {
 	t.chunkMu.Lock()
 	defer t.chunkMu.Unlock()
 
@@ -159,16 +567,18 @@ func (t *FCMTransport) handleChunked(data map[string]string) {
 	if !ok {
 		group = &chunkGroup{
 			total:    ct,
+			flags:    flags,
+			codec:    codec,
 			chunks:   make(map[int][]byte),
 			received: time.Now(),
 		}
 		t.chunkBuffer[mid] = group
 	}
 
-	group.chunks[ci] = []byte(chunk)
+	group.chunks[ci] = chunk
 
 	if len(group.chunks) < group.total {
-		return
+		return group, nil
 	}
 
 	// All chunks received — reassemble.
@@ -181,32 +591,141 @@ func (t *FCMTransport) handleChunked(data map[string]string) {
 	}
 	sort.Ints(indices)
 
-	var assembled []byte
+	assembled := []byte{}
 	for _, i := range indices {
 		assembled = append(assembled, group.chunks[i]...)
 	}
+	return group, assembled
+}
+
+// handleRaw processes a binary web push payload carried in raw_data.
+func (t *FCMTransport) handleRaw(dm *DataMessage) {
+	if dm.ContentEncoding() != "aes128gcm" {
+		fcmLog.Warn("unsupported raw_data content encoding", "encoding", dm.ContentEncoding())
+		t.receiveFailed("decode")
+		return
+	}
+	body, err := unwrapRFC8188(dm.RawData)
+	if err != nil {
+		fcmLog.Warn("bad raw_data", errAttr(err))
+		t.receiveFailed("decode")
+		return
+	}
+	env, chunk, err := decodeRawEnvelope(body)
+	if err != nil {
+		fcmLog.Warn("bad raw_data", errAttr(err))
+		t.receiveFailed("decode")
+		return
+	}
+
+	flags := int(env.flags)
+	t.notePeerFlags(flags)
+
+	mid := rawMessageID(env.mid)
+	if env.count == 1 {
+		t.traceEvent(TraceEvent{Dir: "recv", Event: traceMessage, Path: "raw", MID: mid, Size: len(dm.RawData), Flags: flags})
+		t.deliverSealed(chunk, flags, mid)
+		return
+	}
+	t.traceEvent(TraceEvent{Dir: "recv", Event: traceMessage, Path: "raw", MID: mid, Chunk: []int{int(env.index), int(env.count)}, Size: len(dm.RawData), Flags: flags})
+	if _, assembled := t.collectChunk(mid, int(env.index), int(env.count), flags, "", chunk); assembled != nil {
+		t.deliverSealed(assembled, flags, mid)
+	}
+}
+
+func (t *FCMTransport) decryptAndDeliver(encoded, codecID string, flags int, mid string) {
+	codec, err := codecByID(codecID)
+	if err != nil {
+		fcmLog.Warn("unknown payload codec", errAttr(err))
+		t.receiveFailed("decode")
+		return
+	}
+	sealed, err := codec.Decode(encoded)
+	if err != nil {
+		fcmLog.Warn("payload decode failed", errAttr(err))
+		t.receiveFailed("decode")
+		return
+	}
 
-	t.decryptAndDeliver(string(assembled))
+	t.deliverSealed(sealed, flags, mid)
 }
 
-func (t *FCMTransport) decryptAndDeliver(encrypted string) {
-	plaintext, err := t.crypto.Decrypt(encrypted)
+// deliverSealed decrypts (and if flagged, inflates) a sealed frame and hands
+// it to onFrame. mid is the ID of the message(s) it came in, for the trace.
+func (t *FCMTransport) deliverSealed(sealed []byte, flags int, mid string) {
+	plaintext, err := t.Crypto().Open(sealed)
 	if err != nil {
-		log.Printf("[fcm-transport] decrypt error: %v", err)
+		fcmLog.Warn("decrypt failed", errAttr(err))
+		t.receiveFailed("decrypt")
 		return
 	}
 
+	if flags&flagCompressed != 0 {
+		plaintext, err = decompressPayload(plaintext, frameHeaderSize+MaxPayloadSize)
+		if err != nil {
+			fcmLog.Warn("decompress failed", errAttr(err))
+			t.receiveFailed("decompress")
+			return
+		}
+	}
+
 	frame, err := DecodeFrame(plaintext)
 	if err != nil {
-		log.Printf("[fcm-transport] frame decode error: %v", err)
+		fcmLog.Warn("frame decode failed", errAttr(err))
+		t.receiveFailed("frame")
 		return
 	}
+	framesReceived.Inc(frameTypeName(frame.Type))
+	t.traceEvent(TraceEvent{Dir: "recv", Event: traceFrame, Frame: frameTypeName(frame.Type), Channel: frame.ChannelID, MID: mid, Len: len(frame.Payload), Size: len(sealed), Flags: flags})
 
+	if frame.Type == FrameProbe {
+		if t.onProbe != nil {
+			t.onProbe(frame)
+		}
+		return
+	}
 	if t.onFrame != nil {
 		t.onFrame(frame)
 	}
 }
 
+// ProbeChunkSize empirically finds the largest data payload FCM accepts by
+// sending filler messages of varying size to our own token, then sets the
+// chunk size accordingly. Probe messages are marked with their own type and
+// dropped when MCS delivers them back to us.
+func (t *FCMTransport) ProbeChunkSize() (int, error) {
+	if t.creds == nil || t.creds.FCMToken == "" {
+		return 0, errors.New("probe: no own FCM token")
+	}
+
+	// lo is the largest size known to be accepted, hi the smallest rejected.
+	lo, hi := 0, probeMaxSize+1
+	size := probeMinSize
+	for hi-lo > probePrecision {
+		err := t.sender.SendData(t.creds.FCMToken, map[string]string{
+			"type": probeMessageType,
+			"p":    strings.Repeat("x", size),
+		})
+		switch {
+		case err == nil:
+			lo = size
+		case errors.Is(err, errMessageTooBig):
+			hi = size
+		default:
+			return 0, fmt.Errorf("probe at %d bytes: %w", size, err)
+		}
+		size = lo + (hi-lo)/2
+	}
+
+	if lo <= probeMargin {
+		return 0, fmt.Errorf("probe: FCM rejected even %d byte payloads", hi)
+	}
+	chunk := lo - probeMargin
+	fcmLog.Info("chunk size probed", "largest_accepted", lo, "chunk_size", chunk)
+	t.SetChunkSize(chunk)
+	return chunk, nil
+}
+
 // CleanStaleChunks removes chunk groups older than chunkTimeout.
 func (t *FCMTransport) CleanStaleChunks() {
 	t.chunkMu.Lock()
@@ -215,9 +734,10 @@ func (t *FCMTransport) CleanStaleChunks() {
 	now := time.Now()
 	for mid, group := range t.chunkBuffer {
 		if now.Sub(group.received) > chunkTimeout {
-			log.Printf("[fcm-transport] dropping stale chunk group %s (%d/%d received)",
-				mid, len(group.chunks), group.total)
+			fcmLog.Warn("dropping stale chunk group", "mid", mid, "received", len(group.chunks), "total", group.total)
 			delete(t.chunkBuffer, mid)
+			chunkGroupsExpired.Inc()
+			t.traceEvent(TraceEvent{Dir: "recv", Event: traceExpired, MID: mid, Received: len(group.chunks), Total: group.total})
 		}
 	}
 }
@@ -236,6 +756,79 @@ func (t *FCMTransport) StartChunkCleaner(stop chan struct{}) {
 	}
 }
 
+// receiveFailed counts a received message that yielded no frame.
+func (t *FCMTransport) receiveFailed(reason string) {
+	receiveErrors.Inc(reason)
+	t.traceEvent(TraceEvent{Dir: "recv", Event: traceReceiveError, Error: reason})
+}
+
+// traceEvent records ev under the transport's session.
+func (t *FCMTransport) traceEvent(ev TraceEvent) {
+	if trace.Enabled() {
+		ev.Session = t.session
+		trace.record(ev)
+	}
+}
+
+// traceSent records a message sent over path, or the class of the error
+// refusing it.
+func (t *FCMTransport) traceSent(path, mid string, chunk []int, size int, err error) {
+	ev := TraceEvent{Dir: "send", Event: traceMessage, Path: path, MID: mid, Chunk: chunk, Size: size}
+	if err != nil {
+		ev.Event, ev.Error = traceSendError, errClass(err)
+	}
+	t.traceEvent(ev)
+}
+
+// messageID returns the ID a data message is traced under: its mid if it is
+// a chunk, otherwise one derived from the payload, which sender and receiver
+// compute alike.
+func messageID(data map[string]string) string {
+	if mid := data["mid"]; mid != "" {
+		return mid
+	}
+	payload := joinPayload(data)
+	if payload == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(payload))
+	return "d:" + hex.EncodeToString(sum[:8])
+}
+
+// rawMessageID returns the ID web pushes carrying the envelope mid are
+// traced under.
+func rawMessageID(mid [8]byte) string {
+	return "raw:" + hex.EncodeToString(mid[:])
+}
+
+// rawTracePosition returns the traced ID and chunk position of a web push,
+// or nothing if it does not decode.
+func rawTracePosition(raw []byte) (string, []int) {
+	body, err := unwrapRFC8188(raw)
+	if err != nil {
+		return "", nil
+	}
+	env, _, err := decodeRawEnvelope(body)
+	if err != nil {
+		return "", nil
+	}
+	if env.count == 1 {
+		return rawMessageID(env.mid), nil
+	}
+	return rawMessageID(env.mid), []int{int(env.index), int(env.count)}
+}
+
+// chunkPosition returns the index and count of a chunked data message, or
+// nil if it is not chunked.
+func chunkPosition(data map[string]string) []int {
+	if data["mid"] == "" {
+		return nil
+	}
+	ci, _ := strconv.Atoi(data["ci"])
+	ct, _ := strconv.Atoi(data["ct"])
+	return []int{ci, ct}
+}
+
 func randomMessageID() string {
 	b := make([]byte, 8)
 	rand.Read(b)
@@ -2,21 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	checkinURL  = "https://android.clients.google.com/checkin"
 	registerURL = "https://android.clients.google.com/c2dm/register3"
 	credsFile   = "gcm_credentials.json"
+
+	// webPushSubtype is the app id of our web push registration; the origin
+	// is arbitrary but must stay stable across re-registrations.
+	webPushSubtype = "wp:https://weatherpulse.app/#push-tunnel"
 )
 
 // GCMCredentials holds the device registration state.
@@ -24,48 +31,141 @@ type GCMCredentials struct {
 	AndroidID     uint64 `json:"android_id"`
 	SecurityToken uint64 `json:"security_token"`
 	FCMToken      string `json:"fcm_token"`
+	WebPushToken  string `json:"webpush_token,omitempty"`
+	CheckinAt     int64  `json:"checkin_at,omitempty"` // unix seconds of the last checkin
+
+	store credStore // where the credentials are persisted
+}
+
+// credStore is the file an identity's credentials are persisted to. With a
+// secret set, the file is sealed with a key derived from it, so reading it
+// is not enough to impersonate the identity.
+type credStore struct {
+	path   string
+	secret string
+}
+
+// sealedCredentials is the on-disk form of encrypted credentials.
+type sealedCredentials struct {
+	Salt   []byte `json:"salt"`   // for the PBKDF2 key derivation
+	Sealed []byte `json:"sealed"` // nonce || AES-256-GCM(credentials JSON)
+}
+
+// credentialsAAD binds sealed credentials to their purpose.
+const credentialsAAD = "push-tunnel-credentials"
+
+// errCredentialsKey means the credentials on disk cannot be opened with the
+// configured secret. Registering anew would lose the identity, so callers
+// must not treat it like missing credentials.
+var errCredentialsKey = errors.New("gcm: credentials are encrypted with a different key, or no key is configured")
+
+// instancePath returns the file for identity index, inserting the index
+// before the extension for all but the first: creds.json, creds.1.json, ...
+func instancePath(base string, index int) string {
+	if index == 0 {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), index, ext)
 }
 
 // RegisterGCM performs checkin + registration, returning an FCM token.
-// Credentials are persisted to disk so subsequent runs skip registration.
-func RegisterGCM(senderID string) (*GCMCredentials, error) {
+// Credentials are persisted to store so subsequent runs skip registration.
+func RegisterGCM(senderID string, store credStore) (*GCMCredentials, error) {
 	// Try loading existing credentials.
-	creds, err := loadCredentials()
+	creds, err := loadCredentials(store)
+	if errors.Is(err, errCredentialsKey) {
+		return nil, err
+	}
 	if err == nil && creds.FCMToken != "" {
-		log.Printf("[gcm] loaded existing credentials (androidId=%d)", creds.AndroidID)
+		gcmLog.Info("loaded existing credentials", "android_id", creds.AndroidID)
 		return creds, nil
 	}
 
-	log.Println("[gcm] no existing credentials, performing checkin...")
+	gcmLog.Info("no existing credentials; checking in")
+	return ReregisterGCM(senderID, store)
+}
 
+// ReregisterGCM discards any existing identity and performs a fresh checkin
+// and registration, persisting the result to store. Used when MCS rejects our
+// credentials.
+func ReregisterGCM(senderID string, store credStore) (*GCMCredentials, error) {
 	// Step 1: Checkin.
-	androidID, securityToken, err := doCheckin()
+	androidID, securityToken, err := doCheckin(0, 0)
 	if err != nil {
 		return nil, fmt.Errorf("checkin: %w", err)
 	}
-	log.Printf("[gcm] checkin ok: androidId=%d", androidID)
+	gcmLog.Info("checked in", "android_id", androidID)
 
 	// Step 2: Register for FCM.
-	fcmToken, err := doRegister(androidID, securityToken, senderID)
+	fcmToken, err := doRegister(androidID, securityToken, senderID, senderID)
 	if err != nil {
 		return nil, fmt.Errorf("register: %w", err)
 	}
-	log.Printf("[gcm] registered, token=%s…", truncate(fcmToken, 20))
+	gcmLog.Info("registered", tokenAttr(fcmToken))
 
-	creds = &GCMCredentials{
+	creds := &GCMCredentials{
 		AndroidID:     androidID,
 		SecurityToken: securityToken,
 		FCMToken:      fcmToken,
+		CheckinAt:     time.Now().Unix(),
+		store:         store,
 	}
 
 	if err := saveCredentials(creds); err != nil {
-		log.Printf("[gcm] warning: failed to save credentials: %v", err)
+		gcmLog.Warn("saving credentials failed", errAttr(err))
 	}
 
 	return creds, nil
 }
 
-func doCheckin() (uint64, uint64, error) {
+// RegisterWebPush obtains a web push token for our device, registered against
+// the given VAPID application server key, and persists it with the other
+// credentials. A token already on disk is reused.
+func RegisterWebPush(creds *GCMCredentials, appServerKey string) error {
+	if creds.WebPushToken != "" {
+		return nil
+	}
+	token, err := doRegister(creds.AndroidID, creds.SecurityToken, webPushSubtype, appServerKey)
+	if err != nil {
+		return fmt.Errorf("webpush register: %w", err)
+	}
+	gcmLog.Info("registered for web push", tokenAttr(token))
+	creds.WebPushToken = token
+	if err := saveCredentials(creds); err != nil {
+		gcmLog.Warn("saving credentials failed", errAttr(err))
+	}
+	return nil
+}
+
+// RefreshCheckin checks in again with the existing identity, as Chrome does
+// periodically to keep a device alive. It returns the refreshed credentials,
+// which carry a new FCM token if the server handed out a new identity.
+func RefreshCheckin(creds *GCMCredentials, senderID string) (*GCMCredentials, error) {
+	androidID, securityToken, err := doCheckin(creds.AndroidID, creds.SecurityToken)
+	if err != nil {
+		return nil, fmt.Errorf("checkin: %w", err)
+	}
+	fresh := *creds
+	fresh.CheckinAt = time.Now().Unix()
+	if androidID != creds.AndroidID || securityToken != creds.SecurityToken {
+		gcmLog.Info("checkin returned a new identity; registering", "android_id", androidID)
+		fcmToken, err := doRegister(androidID, securityToken, senderID, senderID)
+		if err != nil {
+			return nil, fmt.Errorf("register: %w", err)
+		}
+		fresh.AndroidID, fresh.SecurityToken = androidID, securityToken
+		fresh.FCMToken, fresh.WebPushToken = fcmToken, ""
+	}
+	if err := saveCredentials(&fresh); err != nil {
+		gcmLog.Warn("saving credentials failed", errAttr(err))
+	}
+	return &fresh, nil
+}
+
+// doCheckin checks in as a Chrome device. A zero androidID requests a new
+// device; otherwise the existing one is refreshed.
+func doCheckin(androidID, securityToken uint64) (uint64, uint64, error) {
 	body := map[string]interface{}{
 		"checkin": map[string]interface{}{
 			"type": 3,
@@ -76,8 +176,8 @@ func doCheckin() (uint64, uint64, error) {
 			},
 		},
 		"version":       3,
-		"id":            0,
-		"securityToken": 0,
+		"id":            androidID,
+		"securityToken": securityToken,
 	}
 
 	jsonBody, err := json.Marshal(body)
@@ -106,20 +206,22 @@ func doCheckin() (uint64, uint64, error) {
 		return 0, 0, fmt.Errorf("decode checkin response: %w", err)
 	}
 
-	androidID, err := parseJSONUint64(raw["android_id"])
+	// A successful response holds our credentials, so unlike an error page
+	// it is never quoted in the errors.
+	newID, err := parseJSONUint64(raw["android_id"])
 	if err != nil {
-		return 0, 0, fmt.Errorf("parse android_id: %w (response: %s)", err, string(respBody))
+		return 0, 0, fmt.Errorf("parse android_id: %w", err)
 	}
-	securityToken, err := parseJSONUint64(raw["security_token"])
+	newToken, err := parseJSONUint64(raw["security_token"])
 	if err != nil {
 		return 0, 0, fmt.Errorf("parse securityToken: %w", err)
 	}
 
-	if androidID == 0 {
-		return 0, 0, fmt.Errorf("checkin returned zero androidId (response: %s)", string(respBody))
+	if newID == 0 {
+		return 0, 0, errors.New("checkin returned zero androidId")
 	}
 
-	return androidID, securityToken, nil
+	return newID, newToken, nil
 }
 
 // parseJSONUint64 parses a JSON value that may be a number or a quoted string.
@@ -140,12 +242,14 @@ func parseJSONUint64(raw json.RawMessage) (uint64, error) {
 	return 0, fmt.Errorf("cannot parse %s as uint64", string(raw))
 }
 
-func doRegister(androidID, securityToken uint64, senderID string) (string, error) {
+// doRegister registers app id subtype for pushes from sender, which is either
+// a numeric sender ID or a base64url VAPID public key.
+func doRegister(androidID, securityToken uint64, subtype, sender string) (string, error) {
 	form := url.Values{}
 	form.Set("app", "org.chromium.linux")
-	form.Set("X-subtype", senderID)
+	form.Set("X-subtype", subtype)
 	form.Set("device", strconv.FormatUint(androidID, 10))
-	form.Set("sender", senderID)
+	form.Set("sender", sender)
 
 	req, err := http.NewRequest("POST", registerURL, strings.NewReader(form.Encode()))
 	if err != nil {
@@ -169,25 +273,46 @@ func doRegister(androidID, securityToken uint64, senderID string) (string, error
 		return "", fmt.Errorf("register returned %d: %s", resp.StatusCode, string(respBody))
 	}
 
-	// Response is key=value pairs, one per line. We want "token=...".
+	// Response is key=value pairs, one per line. We want "token=...", or
+	// else the reason in "Error=...".
+	reason := "none given"
 	for _, line := range strings.Split(string(respBody), "\n") {
 		if strings.HasPrefix(line, "token=") {
 			return strings.TrimPrefix(line, "token="), nil
 		}
+		if strings.HasPrefix(line, "Error=") {
+			reason = strings.TrimPrefix(line, "Error=")
+		}
 	}
 
-	return "", fmt.Errorf("no token in register response: %s", string(respBody))
+	return "", fmt.Errorf("no token in register response: %s", reason)
 }
 
-func loadCredentials() (*GCMCredentials, error) {
-	data, err := os.ReadFile(credsFile)
+func loadCredentials(store credStore) (*GCMCredentials, error) {
+	data, err := os.ReadFile(store.path)
 	if err != nil {
 		return nil, err
 	}
-	var creds GCMCredentials
+	var sealed sealedCredentials
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	if sealed.Sealed != nil {
+		if data, err = openCredentials(sealed, store.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	creds := GCMCredentials{store: store}
 	if err := json.Unmarshal(data, &creds); err != nil {
 		return nil, err
 	}
+	if sealed.Sealed == nil && store.secret != "" {
+		gcmLog.Info("encrypting plaintext credentials", "path", store.path)
+		if err := saveCredentials(&creds); err != nil {
+			return nil, err
+		}
+	}
 	return &creds, nil
 }
 
@@ -196,7 +321,56 @@ func saveCredentials(creds *GCMCredentials) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(credsFile, data, 0600)
+	if creds.store.secret != "" {
+		sealed, err := sealCredentials(data, creds.store.secret)
+		if err != nil {
+			return err
+		}
+		if data, err = json.MarshalIndent(sealed, "", "  "); err != nil {
+			return err
+		}
+	}
+	// Write through a temporary file so a crash never leaves the only
+	// copy of the identity half-written.
+	tmp := creds.store.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, creds.store.path)
+}
+
+func sealCredentials(data []byte, secret string) (*sealedCredentials, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &sealedCredentials{
+		Salt:   salt,
+		Sealed: aead.Seal(nonce, nonce, data, []byte(credentialsAAD)),
+	}, nil
+}
+
+func openCredentials(sealed sealedCredentials, secret string) ([]byte, error) {
+	if secret == "" || len(sealed.Sealed) < nonceSize {
+		return nil, errCredentialsKey
+	}
+	aead, err := passphraseAEAD(secret, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, sealed.Sealed[:nonceSize], sealed.Sealed[nonceSize:], []byte(credentialsAAD))
+	if err != nil {
+		return nil, errCredentialsKey
+	}
+	return data, nil
 }
 
 func truncate(s string, n int) string {
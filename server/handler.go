@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,7 +19,29 @@ type Server struct {
 	sessions  *SessionManager
 	relay     *RelayManager
 	transport *FCMTransport // nil if FCM not configured
+	tokens    *TokenManager // nil if FCM not configured
+	mcs       []*MCSClient  // one per identity; nil if FCM not configured
+	selfTest  *SelfTest     // nil if FCM not configured
 	cfg       Config
+	started   time.Time
+
+	// FCM peers by session ID: the PSK holder and each invited user.
+	peersMu sync.RWMutex
+	peers   map[string]*peerLink
+
+	// Shutdown: draining refuses new channels, stopDrains tells the
+	// downstream drainers to send what is queued and exit.
+	draining   atomic.Bool
+	stopDrains chan struct{}
+	drainers   sync.WaitGroup
+}
+
+// peerLink is the transport serving one peer session, and where the tokens
+// that peer announces are kept.
+type peerLink struct {
+	transport  *FCMTransport
+	tokensPath string
+	stop       chan struct{} // closed when the peer is removed
 }
 
 // NewServer creates a new server instance.
@@ -27,7 +52,90 @@ func NewServer(crypto *Crypto, cfg Config) *Server {
 		sessions: sm,
 		relay:    NewRelayManager(crypto),
 		cfg:      cfg,
+		started:  time.Now(),
+		peers:    make(map[string]*peerLink),
+
+		stopDrains: make(chan struct{}),
+	}
+}
+
+// Status reports the state of the identities and peers, for the control
+// socket.
+func (s *Server) Status() RelayStatus {
+	status := RelayStatus{Started: s.started}
+	var tokens []string
+	if s.tokens != nil {
+		tokens = s.tokens.Tokens()
 	}
+	for i, m := range s.mcs {
+		ms := m.Status()
+		id := IdentityStatus{
+			State:       ms.State.String(),
+			LastLogin:   ms.LastLogin,
+			LastMessage: ms.LastMessage,
+			Reconnects:  ms.Reconnects,
+			Unacked:     ms.Unacked,
+		}
+		if i < len(tokens) {
+			id.FCMToken = tokens[i]
+		}
+		status.Identities = append(status.Identities, id)
+	}
+	for sessionID, p := range s.Peers() {
+		peer := PeerStatus{Session: sessionID, PeerTokens: len(p.transport.PeerTokens())}
+		if session := s.sessions.Get(sessionID); session != nil {
+			peer.Channels = session.ChannelCount()
+		}
+		status.Peers = append(status.Peers, peer)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].Session < status.Peers[j].Session })
+	if s.selfTest != nil {
+		status.SelfTest = s.selfTest.Last()
+	}
+	return status
+}
+
+// addPeer registers the transport for a peer session. The first one added
+// is the default transport and must be added before serving.
+func (s *Server) addPeer(sessionID string, transport *FCMTransport, tokensPath string) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	if s.transport == nil {
+		s.transport = transport
+	}
+	s.peers[sessionID] = &peerLink{transport: transport, tokensPath: tokensPath, stop: make(chan struct{})}
+}
+
+// removePeer stops serving a peer session, closes its channels and drops
+// its metrics.
+func (s *Server) removePeer(sessionID string) {
+	s.peersMu.Lock()
+	p, ok := s.peers[sessionID]
+	delete(s.peers, sessionID)
+	s.peersMu.Unlock()
+	if ok {
+		close(p.stop)
+		s.sessions.Remove(sessionID)
+		sessionQueueDrops.Delete(sessionID)
+	}
+}
+
+// peer returns the link of a peer session, or nil.
+func (s *Server) peer(sessionID string) *peerLink {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	return s.peers[sessionID]
+}
+
+// Peers returns the links of all peer sessions by session ID.
+func (s *Server) Peers() map[string]*peerLink {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	peers := make(map[string]*peerLink, len(s.peers))
+	for id, p := range s.peers {
+		peers[id] = p
+	}
+	return peers
 }
 
 // SetupRoutes registers all HTTP handlers (decoy + legacy).
@@ -36,19 +144,111 @@ func (s *Server) SetupRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/v2/health", s.handleHealth)
 }
 
-// drainDownstream reads frames from the FCM peer session's downstream
-// channel and sends them to the peer via FCM transport.
-func (s *Server) drainDownstream(transport *FCMTransport) {
-	session := s.sessions.GetOrCreate("fcm-peer")
-	log.Println("[relay] starting FCM downstream drain for peer")
-	for {
-		frame := <-session.downstream
-		if err := transport.SendFrame(frame); err != nil {
-			log.Printf("[relay] FCM send error: %v", err)
+// startPeer starts sending a peer session's downstream frames to the peer
+// and cleaning up its transport's stale chunks, until the peer is removed or
+// the relay shuts down.
+func (s *Server) startPeer(sessionID string) {
+	p := s.peer(sessionID)
+	s.drainers.Add(1)
+	go s.drainDownstream(sessionID, p)
+	go p.transport.StartChunkCleaner(p.stop)
+}
+
+// drainDownstream reads frames from an FCM peer session's downstream
+// channel and sends them to the peer via its FCM transport. Once stopDrains
+// is closed it sends whatever is still queued and returns.
+func (s *Server) drainDownstream(sessionID string, p *peerLink) {
+	defer s.drainers.Done()
+	session := s.sessions.GetOrCreate(sessionID)
+	relayLog.Info("starting downstream drain", "session", sessionID)
+	send := func(frame Frame) {
+		if err := p.transport.SendFrame(frame); err != nil {
+			relayLog.Warn("sending downstream frame failed", "session", sessionID, sensitiveErrAttr(err))
 		}
 		// Small delay to avoid rate limiting.
 		time.Sleep(10 * time.Millisecond)
 	}
+	for {
+		select {
+		case frame := <-session.downstream:
+			send(frame)
+		case <-p.stop:
+			return
+		case <-s.stopDrains:
+			for {
+				select {
+				case frame := <-session.downstream:
+					send(frame)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown winds the relay down: it refuses new channels, closes the open
+// ones (each telling the client with a DISCONNECT) and sends what is queued
+// downstream, giving up when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	channels := 0
+	for _, session := range s.sessions.All() {
+		channels += session.ChannelCount()
+		session.CloseAll()
+	}
+	relayLog.Info("shutting down: channels closed, draining downstream", "channels", channels)
+	if err := s.relay.Wait(ctx); err != nil {
+		return err
+	}
+	close(s.stopDrains)
+
+	done := make(chan struct{})
+	go func() {
+		s.drainers.Wait()
+		close(done)
+	}()
+	defer func() {
+		for id := range s.Peers() {
+			s.removePeer(id)
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		dropped := 0
+		for _, session := range s.sessions.All() {
+			dropped += len(session.downstream)
+		}
+		relayLog.Warn("shutdown deadline passed with frames unsent", "frames", dropped)
+		return ctx.Err()
+	}
+}
+
+// announceTokens tells peers our current receive tokens: the given sessions
+// in answer to their HELLO, or all of them after an identity was
+// re-registered.
+func (s *Server) announceTokens(sessionIDs ...string) {
+	if s.tokens == nil {
+		return
+	}
+	payload, err := json.Marshal(TokensPayload{
+		FCMTokens:    s.tokens.Tokens(),
+		WebPushToken: s.tokens.Credentials(0).WebPushToken,
+	})
+	if err != nil {
+		return
+	}
+	if len(sessionIDs) == 0 {
+		for id := range s.Peers() {
+			sessionIDs = append(sessionIDs, id)
+		}
+	}
+	for _, id := range sessionIDs {
+		session := s.sessions.GetOrCreate(id)
+		session.QueueDownstream(Frame{Type: FrameTokens, Payload: payload})
+	}
 }
 
 // --- Middleware ---
@@ -94,7 +294,9 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleHealth returns a health check response.
+// handleHealth returns a static health check response. It says nothing
+// about the relay's state, which a prober could line up with push traffic;
+// use status or the admin metrics for that.
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	addDecoyHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
@@ -106,12 +308,20 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // processUpstreamFrame handles a decrypted frame from the client.
 func (s *Server) processUpstreamFrame(session *Session, f Frame) {
+	session.usage.framesUp.Add(1)
 	switch f.Type {
 	case FrameConnect:
 		target := string(f.Payload)
-		log.Printf("[handler] CONNECT channel %d → %s", f.ChannelID, target)
-		if err := s.relay.Connect(session, f.ChannelID, target); err != nil {
-			log.Printf("[handler] connect failed: %v", err)
+		relayLog.Debug("CONNECT", "session", session.DeviceID, "channel", f.ChannelID, "target", target)
+		if s.draining.Load() {
+			relayLog.Info("shutting down; refusing channel", "session", session.DeviceID, "channel", f.ChannelID)
+			relayConnects.Inc("refused")
+			session.QueueDownstream(Frame{
+				Type:      FrameDisconnect,
+				ChannelID: f.ChannelID,
+			})
+		} else if err := s.relay.Connect(session, f.ChannelID, target); err != nil {
+			relayLog.Warn("connect failed", "session", session.DeviceID, "channel", f.ChannelID, sensitiveErrAttr(err))
 			session.QueueDownstream(Frame{
 				Type:      FrameDisconnect,
 				ChannelID: f.ChannelID,
@@ -128,5 +338,32 @@ func (s *Server) processUpstreamFrame(session *Session, f Frame) {
 		s.relay.Disconnect(session, f.ChannelID)
 	case FrameAck:
 		// Client acknowledged; no-op for now.
+	case FrameHello, FrameTokens:
+		s.learnPeer(session.DeviceID, f.Payload)
+		if f.Type == FrameHello {
+			s.announceTokens(session.DeviceID)
+		}
+	}
+}
+
+// learnPeer switches sending to the tokens announced by the client of a
+// session, and remembers them for the next start.
+func (s *Server) learnPeer(sessionID string, payload []byte) {
+	var tp TokensPayload
+	if err := json.Unmarshal(payload, &tp); err != nil {
+		relayLog.Warn("bad tokens payload", "session", sessionID, errAttr(err))
+		return
+	}
+	p := s.peer(sessionID)
+	if p == nil || len(tp.FCMTokens) == 0 {
+		return
+	}
+	relayLog.Info("peer announced its tokens", "session", sessionID, "fcm_tokens", len(tp.FCMTokens))
+	p.transport.SetPeerTokens(tp.FCMTokens)
+	if tp.WebPushToken != "" {
+		p.transport.SetPeerWebPushToken(tp.WebPushToken)
+	}
+	if err := savePeerTokens(p.tokensPath, tp); err != nil {
+		relayLog.Warn("saving peer tokens failed", "session", sessionID, errAttr(err))
 	}
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatStateFile = "mcs_heartbeat.json"
+
+	// Adaptive heartbeat bounds. We start short so links behind aggressive
+	// NAT survive, then grow while heartbeats keep being acked.
+	initialHeartbeatInterval = 1 * time.Minute
+	minHeartbeatInterval     = 30 * time.Second
+	maxHeartbeatInterval     = 28 * time.Minute
+	heartbeatStep            = 1 * time.Minute
+	// Consecutive acks at the current interval before trying a longer one.
+	heartbeatAcksToGrow = 2
+	// How long an interval that failed stays off limits on a network.
+	heartbeatCeilingTTL = 24 * time.Hour
+)
+
+// learnedHeartbeat is what we remember about one network.
+type learnedHeartbeat struct {
+	IntervalSec int   `json:"interval_sec"`
+	CeilingSec  int   `json:"ceiling_sec,omitempty"`
+	CeilingAt   int64 `json:"ceiling_at,omitempty"` // unix seconds
+}
+
+// AdaptiveHeartbeat learns the longest heartbeat interval a network path
+// tolerates, in the spirit of Android's adaptive heartbeat: it grows the
+// interval by heartbeatStep after successive acks, and when a connection dies
+// of idleness it falls back to the last good interval and remembers the
+// failing one as a ceiling. Learned intervals are kept per network and
+// persisted so a restart does not start the search over.
+type AdaptiveHeartbeat struct {
+	path string // "" keeps state in memory only
+
+	mu        sync.Mutex
+	network   string
+	interval  time.Duration
+	lastGood  time.Duration
+	ceiling   time.Duration
+	ceilingAt time.Time
+	serverMax time.Duration
+	acks      int
+	learned   map[string]learnedHeartbeat
+}
+
+// NewAdaptiveHeartbeat loads learned intervals from path, if it exists.
+func NewAdaptiveHeartbeat(path string) *AdaptiveHeartbeat {
+	h := &AdaptiveHeartbeat{
+		path:     path,
+		interval: initialHeartbeatInterval,
+		learned:  make(map[string]learnedHeartbeat),
+	}
+	if path == "" {
+		return h
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			mcsLog.Warn("heartbeat state", errAttr(err))
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, &h.learned); err != nil {
+		mcsLog.Warn("heartbeat state", errAttr(err))
+	}
+	return h
+}
+
+// Begin starts a connection on the given network and returns the interval
+// to use, restoring whatever was learned there before.
+func (h *AdaptiveHeartbeat) Begin(network string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.network = network
+	h.acks = 0
+	h.interval, h.lastGood = initialHeartbeatInterval, 0
+	h.ceiling, h.ceilingAt = 0, time.Time{}
+	if l, ok := h.learned[network]; ok && l.IntervalSec > 0 {
+		h.interval = time.Duration(l.IntervalSec) * time.Second
+		h.lastGood = h.interval
+		if at := time.Unix(l.CeilingAt, 0); l.CeilingSec > 0 && time.Since(at) < heartbeatCeilingTTL {
+			h.ceiling, h.ceilingAt = time.Duration(l.CeilingSec)*time.Second, at
+		}
+	}
+	h.interval = h.clamp(h.interval)
+	return h.interval
+}
+
+// Interval returns the current heartbeat interval.
+func (h *AdaptiveHeartbeat) Interval() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.interval
+}
+
+// SetServerMax honours a server-provided HeartbeatConfig: we never wait
+// longer than the server asks, though we may heartbeat more often.
+func (h *AdaptiveHeartbeat) SetServerMax(d time.Duration) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.serverMax = d
+	return h.update(h.clamp(h.interval))
+}
+
+// OnAck records a heartbeat acknowledged at the current interval and returns
+// the interval to use next and whether it changed.
+func (h *AdaptiveHeartbeat) OnAck() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastGood = h.interval
+	h.acks++
+	if h.acks < heartbeatAcksToGrow {
+		h.save() // the interval may have just become the last good one
+		return h.interval, false
+	}
+	h.acks = 0
+	return h.update(h.clamp(h.interval + heartbeatStep))
+}
+
+// OnIdleTimeout records that the connection died while idle at the current
+// interval. The interval becomes a ceiling and we retreat to the last one
+// that worked, or halve if none has.
+func (h *AdaptiveHeartbeat) OnIdleTimeout() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ceiling, h.ceilingAt = h.interval, time.Now()
+	next := h.lastGood
+	if next == 0 || next >= h.interval {
+		next = h.interval / 2
+	}
+	h.acks = 0
+	h.lastGood = 0
+	h.update(h.clamp(next))
+	mcsLog.Info("heartbeat interval too long for this network", "ceiling", h.ceiling, "interval", h.interval)
+	return h.interval
+}
+
+// clamp bounds d by the global limits, the server maximum and the learned
+// ceiling. Caller holds h.mu.
+func (h *AdaptiveHeartbeat) clamp(d time.Duration) time.Duration {
+	upper := maxHeartbeatInterval
+	if h.serverMax > 0 && h.serverMax < upper {
+		upper = h.serverMax
+	}
+	if h.ceiling > 0 && h.ceiling-heartbeatStep < upper {
+		upper = h.ceiling - heartbeatStep
+	}
+	if d > upper {
+		d = upper
+	}
+	if d < minHeartbeatInterval {
+		d = minHeartbeatInterval
+	}
+	return d
+}
+
+// update sets the interval and persists it. Caller holds h.mu.
+func (h *AdaptiveHeartbeat) update(d time.Duration) (time.Duration, bool) {
+	changed := d != h.interval
+	h.interval = d
+	h.save()
+	return d, changed
+}
+
+// save persists what we know about the current network, if that changed.
+// Caller holds h.mu.
+func (h *AdaptiveHeartbeat) save() {
+	if h.network == "" {
+		return
+	}
+	good := h.lastGood
+	if good == 0 {
+		good = h.interval
+	}
+	l := learnedHeartbeat{IntervalSec: int(good / time.Second)}
+	if h.ceiling > 0 {
+		l.CeilingSec = int(h.ceiling / time.Second)
+		l.CeilingAt = h.ceilingAt.Unix()
+	}
+	if old, ok := h.learned[h.network]; ok && old == l {
+		return
+	}
+	h.learned[h.network] = l
+	if h.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(h.learned, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(h.path, data, 0600); err != nil {
+		mcsLog.Warn("heartbeat state", errAttr(err))
+	}
+}
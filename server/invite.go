@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Invites bundle everything a new client needs into one string:
+//
+//	ptun://v1/<base64url(JSON)>
+//	ptun://v1e/<base64url(salt[16] || nonce[12] || AES-256-GCM(JSON))>
+//
+// The second form is encrypted with a key derived from a passphrase (see
+// passphraseAEAD), so the invite can travel over a channel the passphrase does
+// not.
+const (
+	invitePrefix        = "ptun://"
+	inviteVersion       = "v1"
+	inviteVersionSealed = "v1e"
+)
+
+// Invite is the decoded content of an invite string. Key is the user's own
+// PSK; the relay knows the user by Name.
+type Invite struct {
+	Name             string          `json:"name"`
+	Key              string          `json:"key"`
+	Project          string          `json:"firebase_project"`
+	SenderID         string          `json:"sender_id"`
+	Credentials      json.RawMessage `json:"firebase_credentials"` // service account key JSON
+	PeerFCMTokens    []string        `json:"peer_fcm_tokens"`
+	WebPushServerKey string          `json:"webpush_server_key,omitempty"`
+}
+
+// IsInvite reports whether s looks like an invite string.
+func IsInvite(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), invitePrefix)
+}
+
+// EncodeInvite serialises inv, encrypting it if passphrase is set.
+func EncodeInvite(inv *Invite, passphrase string) (string, error) {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return invitePrefix + inviteVersion + "/" + base64.RawURLEncoding.EncodeToString(data), nil
+	}
+
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := passphraseAEAD(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := append(salt, nonce...)
+	sealed = aead.Seal(sealed, nonce, data, []byte(inviteVersionSealed))
+	return invitePrefix + inviteVersionSealed + "/" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecodeInvite parses an invite string. passphrase is only needed for
+// encrypted invites.
+func DecodeInvite(s, passphrase string) (*Invite, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(s), invitePrefix)
+	if !ok {
+		return nil, errors.New("invite: missing ptun:// prefix")
+	}
+	version, body, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil, errors.New("invite: missing version")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("invite: %w", err)
+	}
+
+	switch version {
+	case inviteVersion:
+	case inviteVersionSealed:
+		if passphrase == "" {
+			return nil, errors.New("invite: encrypted, passphrase required")
+		}
+		if len(raw) < passphraseSaltSize+nonceSize {
+			return nil, errors.New("invite: truncated")
+		}
+		aead, err := passphraseAEAD(passphrase, raw[:passphraseSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		nonce := raw[passphraseSaltSize : passphraseSaltSize+nonceSize]
+		raw, err = aead.Open(nil, nonce, raw[passphraseSaltSize+nonceSize:], []byte(inviteVersionSealed))
+		if err != nil {
+			return nil, errors.New("invite: wrong passphrase or corrupted invite")
+		}
+	default:
+		return nil, fmt.Errorf("invite: unsupported version %q", version)
+	}
+
+	var inv Invite
+	if err := json.Unmarshal(raw, &inv); err != nil {
+		return nil, fmt.Errorf("invite: %w", err)
+	}
+	if inv.Key == "" {
+		return nil, errors.New("invite: no key")
+	}
+	return &inv, nil
+}
+
+// apply fills the fields of cfg that the invite provides and the config
+// does not set itself.
+func (inv *Invite) apply(cfg *Config) {
+	if cfg.PSK == "" {
+		cfg.PSK = inv.Key
+	}
+	if cfg.Project == "" {
+		cfg.Project = inv.Project
+	}
+	if cfg.SenderID == "" {
+		cfg.SenderID = inv.SenderID
+	}
+	if cfg.FCMCreds == "" && len(inv.Credentials) > 0 {
+		cfg.fcmCredsJSON = inv.Credentials
+	}
+	if cfg.PeerFCMToken == "" && len(cfg.PeerFCMTokens) == 0 {
+		cfg.PeerFCMTokens = inv.PeerFCMTokens
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; sharing a state directory
+// between processes is then not detected.
+func lockFile(f *os.File) error {
+	return nil
+}
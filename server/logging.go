@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Logging is structured (log/slog). Each subsystem logs through its own
+// logger, tagged with a "subsystem" attribute. The level, output format and
+// privacy mode come from the config and can change on reload.
+//
+// Messages are constant; whatever varies goes in attributes. In privacy
+// mode the attributes named in sensitiveKeys are blanked and sensitive
+// errors reduced to their class, so tokens, key material and target
+// hostnames never reach the log.
+var (
+	mcsLog      = subsystemLogger("mcs")
+	gcmLog      = subsystemLogger("gcm")
+	fcmLog      = subsystemLogger("fcm")
+	relayLog    = subsystemLogger("relay")
+	sessionLog  = subsystemLogger("session")
+	selfTestLog = subsystemLogger("self-test")
+	reloadLog   = subsystemLogger("reload")
+	adminLog    = subsystemLogger("admin")
+)
+
+// sensitiveKeys are the attribute keys privacy mode blanks.
+var sensitiveKeys = map[string]bool{
+	"token":         true, // FCM and web push tokens
+	"key_id":        true, // derived from a PSK or user key
+	"android_id":    true, // our GCM device identity
+	"target":        true, // host:port a channel connects to
+	"body":          true, // FCM and web push API responses
+	"persistent_id": true, // IDs of the messages MCS delivered
+	"network":       true, // our local IP, which keys learned heartbeats
+}
+
+const redactedValue = "[redacted]"
+
+var (
+	logLevel   slog.LevelVar
+	logPrivacy atomic.Bool
+	logOutput  atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})
+	logOutput.Store(&h)
+	slog.SetDefault(slog.New(&logHandler{}))
+}
+
+// configureLogging applies the logging settings of cfg.
+func configureLogging(cfg Config) error {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler
+	switch cfg.LogFormat {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("log_format: want text or json, got %q", cfg.LogFormat)
+	}
+	logLevel.Set(level)
+	logPrivacy.Store(cfg.LogPrivacy)
+	logOutput.Store(&h)
+	return nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("log_level: want debug, info, warn or error, got %q", s)
+	}
+	return level, nil
+}
+
+func subsystemLogger(name string) *slog.Logger {
+	return slog.New(&logHandler{}).With("subsystem", name)
+}
+
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, errAttr(err))
+	os.Exit(1)
+}
+
+// tokenAttr logs the start of an FCM or web push token.
+func tokenAttr(token string) slog.Attr {
+	return slog.String("token", truncate(token, 20)+"…")
+}
+
+// errAttr logs err.
+func errAttr(err error) slog.Attr {
+	return slog.Any("err", err)
+}
+
+// sensitiveErrAttr logs an error that may quote a token, a target or a
+// server's response, such as a failed send, dial or GCM checkin. Privacy mode
+// logs only its class.
+func sensitiveErrAttr(err error) slog.Attr {
+	return slog.Any("err", sensitiveErr{err})
+}
+
+type sensitiveErr struct{ err error }
+
+func (e sensitiveErr) LogValue() slog.Value { return slog.StringValue(e.err.Error()) }
+
+func (e sensitiveErr) redacted() slog.Value { return slog.StringValue(errClass(e.err)) }
+
+// errClass names the kind of a send or network error without its details.
+func errClass(err error) string {
+	if class := sendResult(err); class != "error" {
+		return class
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "refused"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "reset"
+	}
+	return "error"
+}
+
+// logHandler hands records to the configured output, redacting them in
+// privacy mode. Attributes and groups added by With are replayed onto the
+// output for each record, so loggers made before configureLogging follow
+// later settings.
+type logHandler struct {
+	ops []func(h slog.Handler, privacy bool) slog.Handler
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	privacy := logPrivacy.Load()
+	out := *logOutput.Load()
+	for _, op := range h.ops {
+		out = op(out, privacy)
+	}
+	if privacy {
+		redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			redacted.AddAttrs(redactAttr(a))
+			return true
+		})
+		r = redacted
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler, privacy bool) slog.Handler {
+		if !privacy {
+			return out.WithAttrs(attrs)
+		}
+		redacted := make([]slog.Attr, len(attrs))
+		for i, a := range attrs {
+			redacted[i] = redactAttr(a)
+		}
+		return out.WithAttrs(redacted)
+	})
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler, _ bool) slog.Handler {
+		return out.WithGroup(name)
+	})
+}
+
+func (h *logHandler) with(op func(slog.Handler, bool) slog.Handler) *logHandler {
+	ops := append(h.ops[:len(h.ops):len(h.ops)], op)
+	return &logHandler{ops: ops}
+}
+
+// redactAttr blanks a in privacy mode if it is sensitive.
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKeys[a.Key] {
+		return slog.String(a.Key, redactedValue)
+	}
+	if a.Value.Kind() == slog.KindLogValuer {
+		if r, ok := a.Value.Any().(interface{ redacted() slog.Value }); ok {
+			return slog.Attr{Key: a.Key, Value: r.redacted()}
+		}
+		a.Value = a.Value.Resolve()
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, g := range group {
+			redacted[i] = redactAttr(g)
+		}
+		return slog.Group(a.Key, redacted...)
+	}
+	return a
+}
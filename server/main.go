@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long a graceful shutdown may take to close
+// channels and send what is queued for the client.
+const shutdownTimeout = 10 * time.Second
+
+// httpShutdownTimeout bounds how long the HTTP server then waits for its
+// remaining requests, however much of shutdownTimeout the tunnel used.
+const httpShutdownTimeout = 2 * time.Second
+
 // Config holds server configuration.
 type Config struct {
 	ListenAddr   string `json:"listen_addr"`
@@ -18,118 +31,515 @@ type Config struct {
 	Project      string `json:"firebase_project"`
 	SenderID     string `json:"sender_id"`
 	PeerFCMToken string `json:"peer_fcm_token"`
+
+	// DisableCompression turns off DEFLATE compression of frames. When
+	// enabled (the default) it is still only used once the peer advertises
+	// support for it.
+	DisableCompression bool `json:"disable_compression"`
+
+	// PayloadCodec selects the text encoding of ciphertext in FCM data
+	// values ("base64" or "z85"), DataKeys spreads each payload over that
+	// many keys, and ProbeChunkSize finds the usable payload size at startup.
+	PayloadCodec   string `json:"payload_codec"`
+	DataKeys       int    `json:"data_keys"`
+	ProbeChunkSize bool   `json:"probe_chunk_size"`
+
+	// WebPush registers a web push token so the peer can send us binary
+	// raw_data payloads; PeerWebPushToken is the peer's, used for sending.
+	WebPush          bool   `json:"webpush"`
+	PeerWebPushToken string `json:"peer_webpush_token"`
+
+	// Identities is how many GCM identities (each with its own MCS
+	// connection) to receive on. PeerFCMTokens lists all of the peer's
+	// tokens; each message goes to Redundancy of them.
+	Identities    int      `json:"identities"`
+	PeerFCMTokens []string `json:"peer_fcm_tokens"`
+	Redundancy    int      `json:"redundancy"`
+
+	// Invite is a ptun:// invite filling in whatever the config leaves
+	// unset; InvitePassphrase opens an encrypted one.
+	Invite           string `json:"invite"`
+	InvitePassphrase string `json:"invite_passphrase"`
+
+	// StateDir holds credentials and other runtime state. Defaults to
+	// $STATE_DIRECTORY (set by systemd) or the working directory.
+	StateDir string `json:"state_dir"`
+
+	// EncryptCredentials seals the stored GCM credentials with a key
+	// derived from the PSK, or from CredentialsPassphrase when set.
+	EncryptCredentials    bool   `json:"encrypt_credentials"`
+	CredentialsPassphrase string `json:"credentials_passphrase"`
+
+	// AdminAddr is where the admin endpoints (metrics) listen, apart from
+	// the decoy; unset disables them. AdminToken, when set, must be sent as
+	// a bearer token.
+	AdminAddr  string `json:"admin_addr"`
+	AdminToken string `json:"admin_token"`
+
+	// LogLevel is debug, info (the default), warn or error; LogFormat is
+	// text (the default) or json. LogPrivacy keeps tokens, key IDs and
+	// target hosts out of the log.
+	LogLevel   string `json:"log_level"`
+	LogFormat  string `json:"log_format"`
+	LogPrivacy bool   `json:"log_privacy"`
+
+	// TraceFile, when set, is where every frame and message sent and
+	// received is recorded, for the decode command.
+	TraceFile string `json:"trace_file"`
+
+	// UsageReport is the file the hourly and daily usage of each session
+	// is appended to. Defaults to usage.jsonl in the state directory.
+	UsageReport string `json:"usage_report"`
+
+	// Client-only settings, accepted so both sides can share a config file.
+	SocksPort        int    `json:"socks_port"`
+	WebPushServerKey string `json:"webpush_server_key"`
+
+	// fcmCredsJSON is a service account key carried inline by an invite,
+	// or read from the environment or a file descriptor.
+	fcmCredsJSON []byte
 }
 
 func main() {
-	configPath := flag.String("config", "config.json", "path to config file")
-	listenAddr := flag.String("listen", ":8080", "listen address")
-	psk := flag.String("psk", "", "pre-shared key")
-	flag.Parse()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "register":
+		runRegister(args)
+	case "token":
+		runToken(args)
+	case "selftest":
+		runSelfTest(args)
+	case "status":
+		runStatus(args)
+	case "invite":
+		runInvite(args)
+	case "validate":
+		runValidate(args)
+	case "decode":
+		runDecode(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
 
-	cfg := loadConfig(*configPath, *listenAddr, *psk)
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: push-tunnel [command] [flags]
+
+commands:
+  serve     run the relay (default)
+  register  register the GCM identities and print their FCM tokens
+  token     print the registered FCM tokens
+  selftest  send a probe to each identity and wait for its delivery
+  status    show the status of the running relay
+  invite    add a user and print their invite
+  validate  check the config and report every problem in it
+  decode    summarize a trace recorded with trace_file
+
+Run "push-tunnel <command> -h" for a command's flags.
+`)
+}
 
-	if cfg.PSK == "" {
-		log.Fatal("PSK is required. Set via config file or -psk flag.")
+// serve runs the relay until the HTTP server fails or a signal stops it.
+// On SIGHUP it calls reload and applies the config it returns.
+func serve(cfg Config, reload func() (Config, error)) {
+	warnings, err := cfg.validate()
+	for _, w := range warnings {
+		slog.Warn("config: " + w)
+	}
+	if err != nil {
+		fatal("invalid config", err)
 	}
 
 	crypto, err := NewCrypto(cfg.PSK)
 	if err != nil {
-		log.Fatalf("crypto init: %v", err)
+		fatal("crypto init failed", err)
 	}
 
 	// FCM sender (for sending to peer via FCM HTTP v1 API).
-	fcmSender, err := NewFCMSender(cfg.FCMCreds, cfg.Project)
+	fcmSender, err := newFCMSender(cfg)
 	if err != nil {
-		log.Fatalf("fcm sender init: %v", err)
+		fatal("fcm sender init failed", err)
 	}
 
 	srv := NewServer(crypto, cfg)
 
+	state := StateDir(cfg.StateDir)
+	if err := state.Create(); err != nil {
+		fatal("creating state dir failed", err)
+	}
+	if control, err := serveControl(state, srv); err != nil {
+		relayLog.Warn("control socket unavailable; status will not work", errAttr(err))
+	} else {
+		defer control.Close()
+	}
+
+	usagePath := cfg.UsageReport
+	if usagePath == "" {
+		usagePath = state.Path(usageFile)
+	}
+	reports := startUsageReports(srv.sessions.usage, usagePath)
+
+	if cfg.TraceFile != "" {
+		if err := trace.Open(cfg.TraceFile); err != nil {
+			fatal("opening trace file failed", err)
+		}
+		defer trace.Close()
+		relayLog.Warn("recording a trace of every frame", "path", cfg.TraceFile)
+	}
+
+	reloader := &reloader{srv: srv, state: state, boot: cfg, cfg: cfg}
+
 	// Set up FCM transport if credentials are provided.
-	if cfg.FCMCreds != "" && cfg.SenderID != "" {
-		// Register with GCM to get our own FCM token.
-		creds, err := RegisterGCM(cfg.SenderID)
+	if cfg.hasFCM() {
+		// Register each GCM identity to get our own FCM tokens. Every
+		// identity gets its own MCS connection, so one reconnecting does
+		// not stall the receive path.
+		allCreds, locks, err := openIdentities(cfg, state, false)
 		if err != nil {
-			log.Fatalf("gcm registration: %v", err)
+			fatal("gcm registration failed", err)
 		}
+		defer locks.Close()
+		creds := allCreds[0]
 
-		fmt.Println("")
-		fmt.Println("=== FCM Token (copy to peer's config as peer_fcm_token) ===")
-		fmt.Println(creds.FCMToken)
-		fmt.Println("============================================================")
-		fmt.Println("")
+		// In privacy mode the tokens are only shown by the token command,
+		// so they do not end up in a journal collecting stdout.
+		printTokens := !cfg.LogPrivacy
+		if printTokens {
+			fmt.Println("")
+			fmt.Println("=== FCM Tokens (copy to the client's config as peer_fcm_tokens) ===")
+			for _, c := range allCreds {
+				fmt.Println(c.FCMToken)
+			}
+			fmt.Println("====================================================================")
+			fmt.Println("")
+		}
 
-		// Create FCM transport.
-		transport := NewFCMTransport(crypto, fcmSender, cfg.Project, cfg.PeerFCMToken, func(frame Frame) {
-			// Incoming frame from peer (client) — process as upstream.
-			session := srv.sessions.GetOrCreate("fcm-peer")
-			srv.processUpstreamFrame(session, frame)
-		})
-		transport.SetCredentials(creds)
+		var webPush *WebPushSender
+		if cfg.WebPush {
+			webPush, err = NewWebPushSender(cfg.PSK)
+			if err != nil {
+				fatal("webpush init failed", err)
+			}
+			if err := RegisterWebPush(creds, webPush.PublicKey()); err != nil {
+				fatal("gcm registration failed", err)
+			}
+		}
+		if webPush != nil && printTokens {
+			fmt.Println("=== Web Push Key (copy to peer's config as webpush_server_key) ===")
+			fmt.Println(webPush.PublicKey())
+			fmt.Println("=== Web Push Token (copy to peer's config as peer_webpush_token) ===")
+			fmt.Println(creds.WebPushToken)
+			fmt.Println("====================================================================")
+			fmt.Println("")
+		}
 
-		// Start MCS client for receiving.
-		mcs := NewMCSClient(creds.AndroidID, creds.SecurityToken, func(dm *DataMessage) {
-			transport.HandleMCSMessage(dm)
-		})
-		transport.SetMCS(mcs)
-		mcs.Start()
+		// Create an FCM transport per peer: the client holding the PSK,
+		// plus one per invited user with its own key and session. Peers
+		// added on reload get the transport settings of the config then.
+		newPeer := func(cfg Config, crypto *Crypto, sessionID, tokensPath string, peerTokens []string, peerWebPushToken string) *FCMTransport {
+			transport := NewFCMTransport(crypto, fcmSender, cfg.Project, "", func(frame Frame) {
+				// Incoming frame from peer (client) — process as upstream.
+				session := srv.sessions.GetOrCreate(sessionID)
+				srv.processUpstreamFrame(session, frame)
+			})
+			transport.SetUsage(srv.sessions.usage.For(sessionID))
+			transport.SetSession(sessionID)
+			transport.SetPeerTokens(peerTokens)
+			transport.SetRedundancy(cfg.Redundancy)
+			transport.SetCredentials(creds)
+			transport.SetCompression(!cfg.DisableCompression)
+			// cfg has been validated, so the codec exists.
+			if codec, err := CodecByName(cfg.PayloadCodec); err == nil {
+				transport.SetCodec(codec, cfg.DataKeys)
+			}
+			if webPush != nil {
+				transport.SetWebPush(webPush, peerWebPushToken)
+			}
+			// Tokens the client announced in an earlier run are newer
+			// than the config's.
+			if learned, err := loadPeerTokens(tokensPath); err == nil && len(learned.FCMTokens) > 0 {
+				relayLog.Info("using peer tokens learned from HELLO", "session", sessionID, "fcm_tokens", len(learned.FCMTokens))
+				transport.SetPeerTokens(learned.FCMTokens)
+				if learned.WebPushToken != "" {
+					transport.SetPeerWebPushToken(learned.WebPushToken)
+				}
+			}
+			srv.addPeer(sessionID, transport, tokensPath)
+			return transport
+		}
 
-		srv.transport = transport
+		transport := newPeer(cfg, crypto, "fcm-peer", state.Path(peerTokensFile), cfg.peerTokens(), cfg.PeerWebPushToken)
+		router := newKeyRouter(transport)
+		users, err := loadUsers(state.Path(usersFile))
+		if err != nil {
+			fatal("loading users failed", err)
+		}
+		for _, u := range users {
+			userCrypto, err := NewCrypto(u.Key)
+			if err != nil {
+				fatal("user "+u.Name, err)
+			}
+			router.Add(newPeer(cfg, userCrypto, userSessionID(u.Name), state.Path(userPeerTokensPath(u.Name)), nil, ""))
+		}
+		if len(users) > 0 {
+			relayLog.Info("serving invited users", "users", len(users))
+		}
+		reloader.router = router
+		reloader.newPeer = newPeer
+		reloader.users = make(map[string]User, len(users))
+		for _, u := range users {
+			reloader.users[u.Name] = u
+		}
 
-		// Self-test: send a test FCM message to ourselves after a delay.
-		go func() {
-			time.Sleep(5 * time.Second)
-			log.Println("[self-test] sending test FCM message to ourselves...")
-			err := fcmSender.SendData(creds.FCMToken, map[string]string{
-				"type": "test",
-				"d":    "hello-self-test",
+		selfTest := NewSelfTest(transport)
+
+		// The token manager keeps the identities registered.
+		tokens := NewTokenManager(cfg.SenderID, fcmSender, allCreds)
+		if webPush != nil {
+			tokens.SetWebPush(webPush)
+		}
+
+		// Start an MCS client per identity for receiving.
+		var clients []*MCSClient
+		for i, c := range allCreds {
+			i := i
+			mcs := NewMCSClient(c.AndroidID, c.SecurityToken, router.HandleMCSMessage)
+			mcs.SetLogger(mcsLog.With("identity", i))
+			mcs.SetReauth(func() (uint64, uint64, error) {
+				fresh, err := tokens.Reregister(i)
+				if err != nil {
+					return 0, 0, err
+				}
+				return fresh.AndroidID, fresh.SecurityToken, nil
 			})
+			seenIDs, err := OpenPersistentIDStore(state.Path(instancePath(persistentIDsFile, i)))
 			if err != nil {
-				log.Printf("[self-test] send failed: %v", err)
-			} else {
-				log.Println("[self-test] send ok — waiting 30s for MCS delivery...")
+				fatal("opening MCS state failed", err)
 			}
-			// Wait, then check if anything arrived.
-			time.Sleep(30 * time.Second)
-			log.Println("[self-test] 30s elapsed — if no MCS message logged above, delivery failed")
-		}()
+			mcs.SetPersistentIDStore(seenIDs)
+			mcs.SetAdaptiveHeartbeat(NewAdaptiveHeartbeat(state.Path(instancePath(heartbeatStateFile, i))))
+			transport.AddMCS(mcs)
+			clients = append(clients, mcs)
+		}
+		// A re-registered identity needs its MCS client switched over, and
+		// the peer told where to send from now on. A client may re-register
+		// on its first login, so this is wired up before any starts.
+		tokens.OnChange(func(i int, c *GCMCredentials) {
+			clients[i].SetCredentials(c.AndroidID, c.SecurityToken)
+			if i == 0 {
+				for _, p := range srv.Peers() {
+					p.transport.SetCredentials(c)
+				}
+			}
+			srv.announceTokens()
+		})
+		srv.tokens = tokens
+		srv.mcs = clients
+		reloader.tokens = tokens
+		srv.selfTest = selfTest
+
+		stopTokens := make(chan struct{})
+		go tokens.Run(stopTokens)
+		for _, mcs := range clients {
+			mcs.Start()
+		}
 
-		// Start downstream drainer: reads from session and sends via FCM.
-		if cfg.PeerFCMToken != "" {
-			go srv.drainDownstream(transport)
+		if cfg.ProbeChunkSize {
+			go func() {
+				if _, err := transport.ProbeChunkSize(); err != nil {
+					tokens.HandleSendError(creds.FCMToken, err)
+					fcmLog.Warn("chunk size probe failed", "chunk_size", transport.ChunkSize(), sensitiveErrAttr(err))
+				}
+			}()
 		}
 
-		// Start chunk cleaner.
-		stopCleaner := make(chan struct{})
-		go transport.StartChunkCleaner(stopCleaner)
+		// Self-test: check that probes sent to ourselves come back, at
+		// startup and then every selfTestInterval.
+		stopSelfTest := make(chan struct{})
+		go func() {
+			if !waitLoggedIn(clients[0], selfTestTimeout) {
+				selfTestLog.Warn("MCS not logged in yet; testing anyway")
+			}
+			ticker := time.NewTicker(selfTestInterval)
+			defer ticker.Stop()
+			for {
+				result := selfTest.Run(tokens.Tokens(), selfTestTimeout)
+				if result.Passed {
+					selfTestLog.Info("passed", "probes", result)
+				} else {
+					selfTestLog.Warn("failed", "probes", result)
+				}
+				for _, p := range result.Probes {
+					if p.sendErr != nil {
+						tokens.HandleSendError(p.token, p.sendErr)
+					}
+				}
+				select {
+				case <-stopSelfTest:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+
+		// Start a downstream drainer per peer: reads from its session and
+		// sends via FCM. Without peer tokens it waits for the client's HELLO.
+		for sessionID, p := range srv.Peers() {
+			if len(p.transport.PeerTokens()) == 0 {
+				relayLog.Info("no peer token yet; waiting for the client's HELLO", "session", sessionID)
+			}
+			srv.startPeer(sessionID)
+		}
 
 		defer func() {
-			close(stopCleaner)
-			mcs.Stop()
+			close(stopTokens)
+			close(stopSelfTest)
+			for _, mcs := range clients {
+				mcs.Stop()
+			}
 		}()
 	}
 
+	if cfg.AdminAddr != "" {
+		admin, err := serveAdmin(cfg.AdminAddr, cfg.AdminToken, srv)
+		if err != nil {
+			fatal("admin listener failed", err)
+		}
+		defer admin.Close()
+	}
+
 	// Always run the decoy HTTP server.
 	mux := http.NewServeMux()
 	srv.SetupRoutes(mux)
 
-	log.Printf("push-tunnel relay listening on %s", cfg.ListenAddr)
-	if err := http.ListenAndServe(cfg.ListenAddr, mux); err != nil {
-		log.Fatalf("server: %v", err)
+	httpSrv := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpSrv.ListenAndServe() }()
+	relayLog.Info("listening", "addr", cfg.ListenAddr)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-serveErr:
+			fatal("server failed", err)
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				relayLog.Info("shutting down (send again to force)", "signal", sig.String())
+				break wait
+			}
+			next, err := reload()
+			if err == nil {
+				_, err = next.validate()
+			}
+			if err != nil {
+				reloadLog.Error("keeping the running config", errAttr(err))
+				continue
+			}
+			reloader.Reload(next)
+		}
 	}
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				relayLog.Warn("forced exit")
+				os.Exit(1)
+			}
+		}
+	}()
+
+	// Wind down the tunnel, then the HTTP server; the deferred calls stop
+	// the MCS clients and background loops.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		relayLog.Warn("shutdown incomplete", errAttr(err))
+	}
+	reports.Close()
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer httpCancel()
+	if err := httpSrv.Shutdown(httpCtx); err != nil {
+		relayLog.Warn("HTTP server shutdown incomplete", errAttr(err))
+	}
+}
+
+// hasFCM reports whether FCM credentials and a sender ID are configured.
+func (c Config) hasFCM() bool {
+	return (c.FCMCreds != "" || len(c.fcmCredsJSON) > 0) && c.SenderID != ""
+}
+
+// credStore is where identity i's credentials are kept.
+func (c Config) credStore(state StateDir, i int) credStore {
+	store := credStore{path: state.Path(instancePath(credsFile, i))}
+	switch {
+	case c.CredentialsPassphrase != "":
+		store.secret = c.CredentialsPassphrase
+	case c.EncryptCredentials:
+		store.secret = c.PSK
+	}
+	return store
 }
 
-func loadConfig(path, listenFlag, pskFlag string) Config {
+// peerTokens merges peer_fcm_token and peer_fcm_tokens, dropping duplicates.
+func (c Config) peerTokens() []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, t := range append([]string{c.PeerFCMToken}, c.PeerFCMTokens...) {
+		if t != "" && !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// readConfig reads the config at path (a file or a ptun:// invite) and
+// applies the CLI flags over it.
+func readConfig(path, listenFlag, pskFlag string) (Config, error) {
 	cfg := Config{
 		ListenAddr: ":8080",
+		StateDir:   defaultStateDir(),
 	}
 
-	// Try loading from file.
-	data, err := os.ReadFile(path)
-	if err == nil {
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			log.Printf("warning: config parse error: %v", err)
+	// The config may itself be an invite; otherwise load it from file.
+	if IsInvite(path) {
+		cfg.Invite = path
+	} else if data, err := os.ReadFile(path); err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
 		}
+	} else if !errors.Is(err, os.ErrNotExist) || path != defaultConfigPath {
+		return cfg, err
+	}
+
+	// Environment variables override file values.
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Invite != "" {
+		passphrase, err := resolveSecret(cfg.InvitePassphrase)
+		if err != nil {
+			return cfg, fmt.Errorf("invite_passphrase: %w", err)
+		}
+		inv, err := DecodeInvite(cfg.Invite, passphrase)
+		if err != nil {
+			return cfg, err
+		}
+		inv.apply(&cfg)
+		slog.Info("imported invite", "user", inv.Name)
 	}
 
 	// CLI flags override file values.
@@ -140,5 +550,25 @@ func loadConfig(path, listenFlag, pskFlag string) Config {
 		cfg.PSK = pskFlag
 	}
 
-	return cfg
+	// Secrets may be held outside the config file.
+	for name, v := range map[string]*string{
+		"psk":                    &cfg.PSK,
+		"credentials_passphrase": &cfg.CredentialsPassphrase,
+		"admin_token":            &cfg.AdminToken,
+	} {
+		secret, err := resolveSecret(*v)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", name, err)
+		}
+		*v = secret
+	}
+	if isSecretRef(cfg.FCMCreds) {
+		key, err := resolveSecret(cfg.FCMCreds)
+		if err != nil {
+			return cfg, fmt.Errorf("firebase_credentials: %w", err)
+		}
+		cfg.FCMCreds, cfg.fcmCredsJSON = "", []byte(key)
+	}
+
+	return cfg, nil
 }
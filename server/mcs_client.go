@@ -2,20 +2,64 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	mtalkHost         = "mtalk.google.com:5228"
-	heartbeatInterval = 4 * time.Minute
+	mtalkHost  = "mtalk.google.com:5228"
+	readBufMCS = 8192
+
+	// Reconnect backoff: doubles from reconnectDelay up to reconnectMaxDelay
+	// while sessions fail before login, and resets after a LoginResponse.
 	reconnectDelay    = 5 * time.Second
-	readBufMCS        = 8192
+	reconnectMaxDelay = 5 * time.Minute
 )
 
+// errServerClose is returned from a session ended by a Close stanza.
+var errServerClose = errors.New("server sent Close")
+
+// MCSState is the state of the MCS connection.
+type MCSState int
+
+const (
+	MCSDisconnected MCSState = iota
+	MCSConnecting            // dialling mtalk
+	MCSConnected             // TLS up, LoginRequest sent
+	MCSLoggedIn              // LoginResponse received; pushes flow
+)
+
+func (s MCSState) String() string {
+	switch s {
+	case MCSDisconnected:
+		return "disconnected"
+	case MCSConnecting:
+		return "connecting"
+	case MCSConnected:
+		return "connected"
+	case MCSLoggedIn:
+		return "logged_in"
+	}
+	return fmt.Sprintf("MCSState(%d)", int(s))
+}
+
+// MCSStatus is a snapshot of the connection health.
+type MCSStatus struct {
+	State       MCSState
+	LastLogin   time.Time // last successful LoginResponse
+	LastMessage time.Time // last DataMessageStanza received
+	Reconnects  int       // reconnect attempts since Start
+	Unacked     int       // sent stanzas the server has not acknowledged
+}
+
 // MCSClient maintains a persistent TLS connection to mtalk.google.com
 // for receiving FCM push messages via the MCS protocol.
 type MCSClient struct {
@@ -30,13 +74,35 @@ type MCSClient struct {
 	wg   sync.WaitGroup
 
 	// Stream ID tracking — MCS requires acknowledging received messages.
-	streamMu             sync.Mutex
-	outStreamID          int // our outgoing message counter
-	lastStreamIDReceived int // last server message counter we received
+	// writeMu keeps stream IDs in the order stanzas hit the wire.
+	writeMu sync.Mutex
+	stream  mcsStream
 
 	// Persistent IDs to acknowledge.
 	ackMu  sync.Mutex
 	ackIDs []string
+
+	// Processed persistent IDs, kept across restarts; nil disables dedup.
+	seenIDs *PersistentIDStore
+
+	// Connection state, exposed via State/Status and OnStateChange.
+	stateMu       sync.Mutex
+	status        MCSStatus
+	stateHandlers []func(MCSState)
+
+	// Adaptive heartbeat interval; hbChanged wakes the heartbeat goroutine
+	// when it changes.
+	heartbeat *AdaptiveHeartbeat
+	hbChanged chan struct{}
+	// timedPing is set when the heartbeat timer (rather than login) sent the
+	// outstanding ping, so only acks after a full idle interval count.
+	timedPing atomic.Bool
+
+	// reauth performs a fresh checkin after an auth error, returning new
+	// credentials. nil means auth errors only trigger a reconnect.
+	reauth func() (androidID, securityToken uint64, err error)
+
+	log *slog.Logger
 }
 
 // NewMCSClient creates a new MCS client.
@@ -46,20 +112,118 @@ func NewMCSClient(androidID, securityToken uint64, onMessage func(*DataMessage))
 		securityToken: securityToken,
 		onMessage:     onMessage,
 		stop:          make(chan struct{}),
+		heartbeat:     NewAdaptiveHeartbeat(""),
+		hbChanged:     make(chan struct{}, 1),
+		log:           mcsLog,
+	}
+}
+
+// SetLogger replaces the logger, e.g. to tell identities apart. Must be
+// called before Start.
+func (m *MCSClient) SetLogger(l *slog.Logger) {
+	m.log = l
+}
+
+// SetPersistentIDStore enables duplicate suppression across restarts. Must be
+// called before Start.
+func (m *MCSClient) SetPersistentIDStore(store *PersistentIDStore) {
+	m.seenIDs = store
+}
+
+// SetAdaptiveHeartbeat replaces the in-memory heartbeat learner with one
+// that persists its state. Must be called before Start.
+func (m *MCSClient) SetAdaptiveHeartbeat(h *AdaptiveHeartbeat) {
+	m.heartbeat = h
+}
+
+// SetReauth sets the function called when login fails with an auth error.
+// It should perform a fresh checkin and return the new credentials.
+func (m *MCSClient) SetReauth(fn func() (androidID, securityToken uint64, err error)) {
+	m.reauth = fn
+}
+
+// SetCredentials switches to a new identity, dropping the current connection
+// so the next login uses it.
+func (m *MCSClient) SetCredentials(androidID, securityToken uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.androidID == androidID && m.securityToken == securityToken {
+		return
+	}
+	m.androidID, m.securityToken = androidID, securityToken
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// OnStateChange registers fn to be called with the new state on every
+// transition. Handlers run synchronously and must not block.
+func (m *MCSClient) OnStateChange(fn func(MCSState)) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.stateHandlers = append(m.stateHandlers, fn)
+}
+
+// State returns the current connection state.
+func (m *MCSClient) State() MCSState {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.status.State
+}
+
+// Status returns a snapshot of the connection health.
+func (m *MCSClient) Status() MCSStatus {
+	m.stateMu.Lock()
+	status := m.status
+	m.stateMu.Unlock()
+	status.Unacked = m.stream.Unacked()
+	return status
+}
+
+func (m *MCSClient) setState(state MCSState) {
+	m.stateMu.Lock()
+	if m.status.State == state {
+		m.stateMu.Unlock()
+		return
+	}
+	m.status.State = state
+	if state == MCSLoggedIn {
+		m.status.LastLogin = time.Now()
+	}
+	handlers := make([]func(MCSState), len(m.stateHandlers))
+	copy(handlers, m.stateHandlers)
+	m.stateMu.Unlock()
+
+	m.log.Info("state changed", "state", state.String())
+	for _, fn := range handlers {
+		fn(state)
 	}
 }
 
+func (m *MCSClient) noteMessage() {
+	m.stateMu.Lock()
+	m.status.LastMessage = time.Now()
+	m.stateMu.Unlock()
+}
+
 // Start begins the MCS connection loop in a goroutine.
 func (m *MCSClient) Start() {
 	m.wg.Add(1)
 	go m.connectLoop()
 }
 
-// Stop closes the MCS connection.
+// Stop closes the MCS connection. A logged-in session first acknowledges
+// the messages still awaiting an ack, so the server does not redeliver them,
+// and says goodbye with a Close stanza.
 func (m *MCSClient) Stop() {
 	close(m.stop)
 	m.mu.Lock()
 	if m.conn != nil {
+		if m.State() == MCSLoggedIn {
+			m.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+			m.flushAcks(m.conn)
+			m.send(m.conn, &Close{}, nil)
+		}
 		m.conn.Close()
 	}
 	m.mu.Unlock()
@@ -69,6 +233,7 @@ func (m *MCSClient) Stop() {
 func (m *MCSClient) connectLoop() {
 	defer m.wg.Done()
 
+	delay := reconnectDelay
 	for {
 		select {
 		case <-m.stop:
@@ -77,20 +242,77 @@ func (m *MCSClient) connectLoop() {
 		}
 
 		err := m.runSession()
+		loggedIn := m.State() == MCSLoggedIn
+		m.setState(MCSDisconnected)
 		if err != nil {
-			log.Printf("[mcs] session error: %v", err)
+			m.log.Warn("session ended", errAttr(err))
+		}
+
+		// The backoff carries on across fresh checkins, so a server that
+		// keeps rejecting us does not get a new identity every few seconds.
+		var loginErr *ErrorInfo
+		if errors.As(err, &loginErr) && loginErr.IsAuthError() && m.reauth != nil {
+			m.log.Warn("credentials rejected; checking in afresh")
+			androidID, securityToken, rerr := m.reauth()
+			if rerr != nil {
+				m.log.Error("fresh checkin failed", sensitiveErrAttr(rerr))
+			} else {
+				m.mu.Lock()
+				m.androidID, m.securityToken = androidID, securityToken
+				m.mu.Unlock()
+			}
+		}
+
+		// A session that got as far as login was healthy; start over.
+		if loggedIn {
+			delay = reconnectDelay
+		}
+		wait := jitter(delay)
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+		// Close is an orderly request to reconnect, not a failure.
+		if errors.Is(err, errServerClose) {
+			wait, delay = 0, reconnectDelay
+		}
+		// A logged-in session that died without the server closing it was
+		// most likely reaped by a middlebox for idling too long.
+		if loggedIn && isIdleDisconnect(err) {
+			m.heartbeat.OnIdleTimeout()
 		}
 
 		select {
 		case <-m.stop:
 			return
-		case <-time.After(reconnectDelay):
-			log.Println("[mcs] reconnecting...")
+		case <-time.After(wait):
+			m.stateMu.Lock()
+			m.status.Reconnects++
+			m.stateMu.Unlock()
+			m.log.Info("reconnecting", "waited", wait.Round(time.Millisecond))
 		}
 	}
 }
 
+// isIdleDisconnect reports whether a session error looks like a silent drop
+// of an idle connection: a read timeout (heartbeat went unanswered) or a
+// reset from a NAT that forgot the mapping.
+func isIdleDisconnect(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
 func (m *MCSClient) runSession() error {
+	m.setState(MCSConnecting)
 	conn, err := tls.Dial("tcp", mtalkHost, &tls.Config{})
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
@@ -99,11 +321,9 @@ func (m *MCSClient) runSession() error {
 	m.conn = conn
 	m.mu.Unlock()
 
-	// Reset stream counters for new session.
-	m.streamMu.Lock()
-	m.outStreamID = 0
-	m.lastStreamIDReceived = 0
-	m.streamMu.Unlock()
+	// Reset stream counters for new session. Selective acks the old session
+	// never saw acknowledged are repeated in the LoginRequest.
+	pending := m.stream.Reset()
 
 	defer func() {
 		conn.Close()
@@ -112,29 +332,54 @@ func (m *MCSClient) runSession() error {
 		m.mu.Unlock()
 	}()
 
-	log.Println("[mcs] connected to", mtalkHost)
+	m.log.Info("connected", "host", mtalkHost)
+
+	// Learned heartbeat intervals are keyed by the local address, which
+	// identifies the network we are on well enough.
+	network := "unknown"
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		network = addr.IP.String()
+	}
+	m.timedPing.Store(false)
+	m.log.Info("heartbeat interval chosen", "interval", m.heartbeat.Begin(network), "network", network)
 
 	// Send LoginRequest (counts as our first outgoing message).
-	loginMsg := BuildLoginRequest(m.androidID, m.securityToken)
-	loginFrame := EncodeMCSMessage(TagLoginRequest, loginMsg, true)
-	if _, err := conn.Write(loginFrame); err != nil {
+	var received []string
+	if m.seenIDs != nil {
+		received = m.seenIDs.Recent(maxLoginPersistentIDs)
+	}
+	received = mergeIDs(received, pending)
+	m.mu.Lock()
+	androidID, securityToken := m.androidID, m.securityToken
+	m.mu.Unlock()
+	login := NewLoginRequest(androidID, securityToken, received)
+	if err := m.send(conn, login, nil); err != nil {
 		return fmt.Errorf("send login: %w", err)
 	}
-	m.incrementOutStream()
+	m.setState(MCSConnected)
 
-	// Start heartbeat ticker.
-	heartbeat := time.NewTicker(heartbeatInterval)
-	defer heartbeat.Stop()
-
-	// Start heartbeat sender goroutine.
+	// Start heartbeat sender goroutine; it exits with the session.
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
+		timer := time.NewTimer(m.heartbeatInterval())
+		defer timer.Stop()
 		for {
 			select {
 			case <-m.stop:
 				return
-			case <-heartbeat.C:
+			case <-done:
+				return
+			case <-m.hbChanged:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(m.heartbeatInterval())
+			case <-timer.C:
+				m.timedPing.Store(true)
 				m.sendHeartbeat(conn)
 				m.flushAcks(conn)
+				timer.Reset(m.heartbeatInterval())
 			}
 		}
 	}()
@@ -150,11 +395,13 @@ func (m *MCSClient) runSession() error {
 		default:
 		}
 
-		conn.SetReadDeadline(time.Now().Add(heartbeatInterval + 30*time.Second))
+		conn.SetReadDeadline(time.Now().Add(m.heartbeatInterval() + 30*time.Second))
 		n, err := conn.Read(buf)
 		if n > 0 {
 			reader.Feed(buf[:n])
-			m.processMessages(reader, conn)
+			if perr := m.processMessages(reader, conn); perr != nil {
+				return perr
+			}
 		}
 		if err != nil {
 			if err == io.EOF {
@@ -165,136 +412,165 @@ func (m *MCSClient) runSession() error {
 	}
 }
 
-func (m *MCSClient) incrementInStream() int {
-	m.streamMu.Lock()
-	defer m.streamMu.Unlock()
-	m.lastStreamIDReceived++
-	return m.lastStreamIDReceived
+func (m *MCSClient) heartbeatInterval() time.Duration {
+	return m.heartbeat.Interval()
 }
 
-func (m *MCSClient) incrementOutStream() int {
-	m.streamMu.Lock()
-	defer m.streamMu.Unlock()
-	m.outStreamID++
-	return m.outStreamID
+// heartbeatChanged re-arms the heartbeat timer after the interval changed.
+func (m *MCSClient) heartbeatChanged(d time.Duration, changed bool) {
+	if !changed {
+		return
+	}
+	m.log.Info("heartbeat interval changed", "interval", d)
+	select {
+	case m.hbChanged <- struct{}{}:
+	default:
+	}
 }
 
-func (m *MCSClient) getStreamIDs() (int, int) {
-	m.streamMu.Lock()
-	defer m.streamMu.Unlock()
-	return m.outStreamID, m.lastStreamIDReceived
+// send stamps a stanza with the next stream ID and writes it. The
+// LoginRequest is the first stanza of a session and carries the version byte.
+func (m *MCSClient) send(conn *tls.Conn, st Stanza, ackIDs []string) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.stream.Send(st, ackIDs)
+	_, err := conn.Write(EncodeStanza(st, st.Tag() == TagLoginRequest))
+	return err
 }
 
-func (m *MCSClient) processMessages(reader *MCSReader, conn *tls.Conn) {
+// processMessages handles every complete message buffered in reader. A
+// non-nil error ends the session.
+func (m *MCSClient) processMessages(reader *MCSReader, conn *tls.Conn) error {
 	for {
 		msg := reader.Next()
 		if msg == nil {
-			return
+			return nil
 		}
 
-		// Every message from the server increments our received counter.
-		streamID := m.incrementInStream()
-
-		switch msg.Tag {
-		case TagLoginResponse:
-			// Parse and log LoginResponse fields for debugging.
-			if fields, err := decodeProtoFields(msg.Body); err == nil {
-				for _, f := range fields {
-					if f.wireType == 2 {
-						log.Printf("[mcs] LoginResponse field %d (string): %q", f.fieldNum, string(f.data))
-					} else if f.wireType == 0 {
-						log.Printf("[mcs] LoginResponse field %d (varint): %d", f.fieldNum, f.varint)
-					}
-				}
+		stanza, err := DecodeStanza(msg)
+		if err != nil {
+			if msg.Tag == TagLoginResponse {
+				return err
+			}
+			m.log.Warn("undecodable stanza", errAttr(err))
+			m.stream.Receive(&RawStanza{tag: msg.Tag})
+			continue
+		}
+		// Every message from the server increments our received counter,
+		// and may acknowledge stanzas we sent.
+		streamID := m.stream.Receive(stanza)
+
+		switch s := stanza.(type) {
+		case *LoginResponse:
+			// Like Chrome, only a nonzero code fails the login.
+			if s.Error != nil && s.Error.Code != 0 {
+				return s.Error
+			}
+			m.log.Info("logged in", "id", s.ID, "stream_id", streamID)
+			if hb := s.HeartbeatConfig; hb != nil && hb.IntervalMs > 0 {
+				m.heartbeatChanged(m.heartbeat.SetServerMax(time.Duration(hb.IntervalMs) * time.Millisecond))
 			}
-			log.Printf("[mcs] login successful (server stream_id=%d)", streamID)
+			m.setState(MCSLoggedIn)
 
 			// Immediately send heartbeat to acknowledge LoginResponse.
 			m.sendHeartbeat(conn)
 
-		case TagHeartbeatPing:
-			log.Printf("[mcs] received HeartbeatPing")
+		case *HeartbeatPing:
+			m.log.Debug("received HeartbeatPing")
 			// Respond with HeartbeatAck including stream ack.
-			_, lastRecv := m.getStreamIDs()
-			ack := EncodeMCSMessage(TagHeartbeatAck, BuildHeartbeatAck(lastRecv), false)
-			conn.Write(ack)
-
-		case TagHeartbeatAck:
-			log.Printf("[mcs] received HeartbeatAck")
-
-		case TagClose:
-			log.Println("[mcs] server sent Close")
-
-		case TagIqStanza:
-			iqType, hasType := uint64(0), false
-			iqID, iqFrom, iqTo := "", "", ""
-			extID, hasExtID := uint64(0), false
-			if fields, err := decodeProtoFields(msg.Body); err == nil {
-				iqType, hasType = getVarintField(fields, 2)
-				iqID = getStringField(fields, 3)
-				iqFrom = getStringField(fields, 4)
-				iqTo = getStringField(fields, 5)
-
-				ext := getRepeatedMessage(fields, 7)
-				if len(ext) > 0 {
-					extID, hasExtID = getVarintField(ext[0], 1)
-				}
-			} else {
-				log.Printf("[mcs] parse IqStanza error: %v", err)
+			if err := m.send(conn, &HeartbeatAck{}, nil); err != nil {
+				m.log.Warn("sending HeartbeatAck failed", errAttr(err))
 			}
 
-			if hasExtID {
-				log.Printf("[mcs] received IqStanza type=%d id=%q ext=%d len=%d", iqType, iqID, extID, len(msg.Body))
+		case *HeartbeatAck:
+			m.log.Debug("received HeartbeatAck")
+			if m.timedPing.Swap(false) {
+				m.heartbeatChanged(m.heartbeat.OnAck())
+			}
+
+		case *Close:
+			m.log.Info("server sent Close")
+			m.flushAcks(conn)
+			return errServerClose
+
+		case *StreamErrorStanza:
+			// The server drops the connection right after a stream error.
+			m.flushAcks(conn)
+			return s
+
+		case *IqStanza:
+			if s.Extension != nil {
+				m.log.Debug("received IqStanza", "type", s.Type, "id", s.ID, "extension", s.Extension.ID, "len", len(msg.Body))
 			} else {
-				log.Printf("[mcs] received IqStanza type=%d id=%q len=%d", iqType, iqID, len(msg.Body))
+				m.log.Debug("received IqStanza", "type", s.Type, "id", s.ID, "len", len(msg.Body))
 			}
 
 			// Server IQ GET/SET stanzas expect a RESULT response with matching id.
-			if hasType && (iqType == 0 || iqType == 1) {
-				resultMsg := BuildIqResult(iqID, iqFrom, iqTo)
-				result := EncodeMCSMessage(TagIqStanza, resultMsg, false)
-				if _, err := conn.Write(result); err != nil {
-					log.Printf("[mcs] iq result send error: %v", err)
-				} else {
-					m.incrementOutStream()
+			if s.Type == IqGet || s.Type == IqSet {
+				if err := m.send(conn, s.Result(), nil); err != nil {
+					m.log.Warn("sending IQ result failed", errAttr(err))
 				}
 			}
 
-		case TagDataMessageStanza:
-			log.Printf("[mcs] received DataMessageStanza, len=%d", len(msg.Body))
-			dm, err := ParseDataMessageStanza(msg.Body)
-			if err != nil {
-				log.Printf("[mcs] parse data message error: %v", err)
-				continue
+		case *DataMessage:
+			m.log.Debug("received DataMessageStanza", "len", len(msg.Body))
+			m.noteMessage()
+
+			duplicate := s.PersistentID != "" && m.seenIDs != nil && m.seenIDs.Seen(s.PersistentID)
+			if duplicate {
+				m.log.Debug("dropping duplicate delivery", "persistent_id", s.PersistentID)
+			} else if m.onMessage != nil {
+				m.onMessage(s)
 			}
 
-			// Queue persistent ID for acknowledgment.
-			if dm.PersistentID != "" {
+			// Queue persistent ID for acknowledgment. Record it as processed
+			// before acking so a crash before the ack lands cannot replay it.
+			if s.PersistentID != "" {
+				if m.seenIDs != nil && !duplicate {
+					if err := m.seenIDs.Add(s.PersistentID); err != nil {
+						m.log.Warn("recording persistent ID failed", errAttr(err))
+					}
+				}
 				m.ackMu.Lock()
-				m.ackIDs = append(m.ackIDs, dm.PersistentID)
+				m.ackIDs = append(m.ackIDs, s.PersistentID)
 				m.ackMu.Unlock()
 				// Ack promptly to reduce duplicate deliveries.
 				m.flushAcks(conn)
 			}
 
-			if m.onMessage != nil {
-				m.onMessage(dm)
-			}
+		case *RawStanza:
+			m.log.Debug("unhandled stanza", "tag", msg.Tag, "len", len(msg.Body))
 
 		default:
-			log.Printf("[mcs] unknown tag %d, len=%d", msg.Tag, len(msg.Body))
+			m.log.Debug("ignoring stanza", "type", fmt.Sprintf("%T", s))
+		}
+
+		if m.stream.NeedsStreamAck() {
+			m.sendStreamAck(conn)
 		}
 	}
 }
 
 func (m *MCSClient) sendHeartbeat(conn *tls.Conn) {
-	outID, lastRecv := m.getStreamIDs()
-	log.Printf("[mcs] sending HeartbeatPing (out=%d, lastRecv=%d)", outID, lastRecv)
-	ping := EncodeMCSMessage(TagHeartbeatPing, BuildHeartbeatPing(outID, lastRecv), false)
-	if _, err := conn.Write(ping); err != nil {
-		log.Printf("[mcs] heartbeat send error: %v", err)
+	outID, lastRecv := m.stream.IDs()
+	m.log.Debug("sending HeartbeatPing", "out", outID+1, "last_received", lastRecv, "unacked", m.stream.Unacked())
+	if err := m.send(conn, &HeartbeatPing{}, nil); err != nil {
+		m.log.Warn("sending HeartbeatPing failed", errAttr(err))
+	}
+}
+
+// sendStreamAck reports our last received stream ID without waiting for
+// another stanza to carry it.
+func (m *MCSClient) sendStreamAck(conn *tls.Conn) {
+	outID, _ := m.stream.IDs()
+	iq := &IqStanza{
+		Type:      IqSet,
+		ID:        fmt.Sprintf("sack-%d", outID+1),
+		Extension: &Extension{ID: ExtensionStreamAck},
+	}
+	if err := m.send(conn, iq, nil); err != nil {
+		m.log.Warn("sending stream ack failed", errAttr(err))
 	}
-	m.incrementOutStream()
 }
 
 func (m *MCSClient) flushAcks(conn *tls.Conn) {
@@ -307,11 +583,24 @@ func (m *MCSClient) flushAcks(conn *tls.Conn) {
 		return
 	}
 
-	outID, _ := m.getStreamIDs()
+	outID, _ := m.stream.IDs()
 	iqID := fmt.Sprintf("ack-%d", outID+1)
-	ack := EncodeMCSMessage(TagIqStanza, BuildSelectiveAck(ids, iqID), false)
-	if _, err := conn.Write(ack); err != nil {
-		log.Printf("[mcs] ack send error: %v", err)
+	if err := m.send(conn, NewSelectiveAck(ids, iqID), ids); err != nil {
+		m.log.Warn("sending selective ack failed", errAttr(err))
+	}
+}
+
+// mergeIDs appends the IDs of extra missing from ids.
+func mergeIDs(ids, extra []string) []string {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range extra {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
 	}
-	m.incrementOutStream()
+	return ids
 }
@@ -0,0 +1,1242 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Typed MCS messages, one Go struct per message in mcs.proto.
+//
+// Scalars follow proto2 presence loosely: required fields are always
+// written, optional ones are omitted when zero. That round-trips everything
+// we or the server send, without pointer-heavy structs. Tags 11–14
+// (HttpRequest, HttpResponse, BindAccountRequest, BindAccountResponse) have no
+// published definition and decode as RawStanza, which keeps the bytes.
+
+// Stanza is a top-level MCS message that travels with its own tag.
+type Stanza interface {
+	Tag() byte
+	Marshal() []byte
+	Unmarshal(data []byte) error
+}
+
+// NewStanza returns an empty stanza for tag, ready for Unmarshal.
+func NewStanza(tag byte) Stanza {
+	switch tag {
+	case TagHeartbeatPing:
+		return &HeartbeatPing{}
+	case TagHeartbeatAck:
+		return &HeartbeatAck{}
+	case TagLoginRequest:
+		return &LoginRequest{}
+	case TagLoginResponse:
+		return &LoginResponse{}
+	case TagClose:
+		return &Close{}
+	case TagMessageStanza:
+		return &MessageStanza{}
+	case TagPresenceStanza:
+		return &PresenceStanza{}
+	case TagIqStanza:
+		return &IqStanza{}
+	case TagDataMessageStanza:
+		return &DataMessage{}
+	case TagBatchPresence:
+		return &BatchPresenceStanza{}
+	case TagStreamError:
+		return &StreamErrorStanza{}
+	case TagTalkMetadata:
+		return &TalkMetadata{}
+	}
+	return &RawStanza{tag: tag}
+}
+
+// DecodeStanza decodes a framed MCS message into its typed stanza.
+func DecodeStanza(msg *MCSMessage) (Stanza, error) {
+	s := NewStanza(msg.Tag)
+	if err := s.Unmarshal(msg.Body); err != nil {
+		return nil, fmt.Errorf("decode %T: %w", s, err)
+	}
+	return s, nil
+}
+
+// EncodeStanza frames a stanza for the wire.
+func EncodeStanza(s Stanza, includeVersion bool) []byte {
+	return EncodeMCSMessage(s.Tag(), s.Marshal(), includeVersion)
+}
+
+// --- Field helpers ---
+
+// protoWriter accumulates an encoded protobuf message.
+type protoWriter []byte
+
+func (w *protoWriter) reqString(num uint64, s string) {
+	*w = append(*w, encodeStringField(num, []byte(s))...)
+}
+
+func (w *protoWriter) string(num uint64, s string) {
+	if s != "" {
+		w.reqString(num, s)
+	}
+}
+
+func (w *protoWriter) strings(num uint64, ss []string) {
+	for _, s := range ss {
+		w.reqString(num, s)
+	}
+}
+
+func (w *protoWriter) bytes(num uint64, b []byte) {
+	if len(b) > 0 {
+		*w = append(*w, encodeStringField(num, b)...)
+	}
+}
+
+func (w *protoWriter) reqVarint(num uint64, v uint64) {
+	*w = append(*w, encodeVarintField(num, v)...)
+}
+
+func (w *protoWriter) varint(num uint64, v uint64) {
+	if v != 0 {
+		w.reqVarint(num, v)
+	}
+}
+
+// int32 and int64 use proto's sign extension for negative values.
+func (w *protoWriter) int32(num uint64, v int32) { w.varint(num, uint64(int64(v))) }
+func (w *protoWriter) int64(num uint64, v int64) { w.varint(num, uint64(v)) }
+
+func (w *protoWriter) bool(num uint64, v bool) {
+	if v {
+		w.reqVarint(num, 1)
+	}
+}
+
+// message writes a sub-message; nil pointers are omitted by the caller.
+func (w *protoWriter) message(num uint64, m interface{ Marshal() []byte }) {
+	*w = append(*w, encodeStringField(num, m.Marshal())...)
+}
+
+func (f protoField) str() string {
+	if f.wireType != 2 {
+		return ""
+	}
+	return string(f.data)
+}
+
+func (f protoField) raw() []byte {
+	if f.wireType != 2 {
+		return nil
+	}
+	return append([]byte(nil), f.data...)
+}
+
+func (f protoField) u64() uint64 {
+	if f.wireType != 0 {
+		return 0
+	}
+	return f.varint
+}
+
+func (f protoField) i32() int32    { return int32(f.u64()) }
+func (f protoField) i64() int64    { return int64(f.u64()) }
+func (f protoField) boolean() bool { return f.u64() != 0 }
+
+// sub decodes a length-delimited field as a message of type T.
+func sub[T any, P interface {
+	*T
+	Unmarshal([]byte) error
+}](f protoField) (*T, error) {
+	if f.wireType != 2 {
+		return nil, fmt.Errorf("field %d: expected message, got wire type %d", f.fieldNum, f.wireType)
+	}
+	v := new(T)
+	if err := P(v).Unmarshal(f.data); err != nil {
+		return nil, fmt.Errorf("field %d: %w", f.fieldNum, err)
+	}
+	return v, nil
+}
+
+// --- Shared sub-messages ---
+
+// Setting is a name/value pair used in LoginRequest and LoginResponse.
+type Setting struct {
+	Name  string // 1
+	Value string // 2
+}
+
+func (m *Setting) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.Name)
+	w.reqString(2, m.Value)
+	return w
+}
+
+func (m *Setting) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = Setting{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.Name = f.str()
+		case 2:
+			m.Value = f.str()
+		}
+	}
+	return nil
+}
+
+// Extension is an opaque typed payload attached to IQ, message and presence
+// stanzas; id 12 carries a SelectiveAck, id 13 a StreamAck.
+type Extension struct {
+	ID   int32  // 1
+	Data []byte // 2
+}
+
+func (m *Extension) Marshal() []byte {
+	var w protoWriter
+	w.reqVarint(1, uint64(int64(m.ID)))
+	w = append(w, encodeStringField(2, m.Data)...)
+	return w
+}
+
+func (m *Extension) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = Extension{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.ID = f.i32()
+		case 2:
+			m.Data = f.raw()
+		}
+	}
+	return nil
+}
+
+// ErrorInfo is an error carried by LoginResponse and other stanzas.
+type ErrorInfo struct {
+	Code      int32      // 1
+	Message   string     // 2
+	Type      string     // 3
+	Extension *Extension // 4
+}
+
+// IsAuthError reports whether the error means our android ID / security
+// token were rejected, so a fresh checkin is needed.
+func (e *ErrorInfo) IsAuthError() bool {
+	return e.Code == 401 || e.Code == 403 || strings.Contains(strings.ToLower(e.Type), "auth")
+}
+
+func (e *ErrorInfo) Error() string {
+	return fmt.Sprintf("mcs error %d (%s): %s", e.Code, e.Type, e.Message)
+}
+
+func (m *ErrorInfo) Marshal() []byte {
+	var w protoWriter
+	w.reqVarint(1, uint64(int64(m.Code)))
+	w.string(2, m.Message)
+	w.string(3, m.Type)
+	if m.Extension != nil {
+		w.message(4, m.Extension)
+	}
+	return w
+}
+
+func (m *ErrorInfo) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = ErrorInfo{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.Code = f.i32()
+		case 2:
+			m.Message = f.str()
+		case 3:
+			m.Type = f.str()
+		case 4:
+			if m.Extension, err = sub[Extension](f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HeartbeatStat reports the outcome of a heartbeat interval at login.
+type HeartbeatStat struct {
+	IP         string // 1
+	Timeout    bool   // 2
+	IntervalMs int32  // 3
+}
+
+func (m *HeartbeatStat) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.IP)
+	w.reqVarint(2, boolVarint(m.Timeout))
+	w.reqVarint(3, uint64(int64(m.IntervalMs)))
+	return w
+}
+
+func (m *HeartbeatStat) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = HeartbeatStat{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.IP = f.str()
+		case 2:
+			m.Timeout = f.boolean()
+		case 3:
+			m.IntervalMs = f.i32()
+		}
+	}
+	return nil
+}
+
+// HeartbeatConfig is the server's heartbeat instruction.
+type HeartbeatConfig struct {
+	UploadStat bool   // 1
+	IP         string // 2
+	IntervalMs int32  // 3
+}
+
+func (m *HeartbeatConfig) Marshal() []byte {
+	var w protoWriter
+	w.bool(1, m.UploadStat)
+	w.string(2, m.IP)
+	w.int32(3, m.IntervalMs)
+	return w
+}
+
+func (m *HeartbeatConfig) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = HeartbeatConfig{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.UploadStat = f.boolean()
+		case 2:
+			m.IP = f.str()
+		case 3:
+			m.IntervalMs = f.i32()
+		}
+	}
+	return nil
+}
+
+// ClientEvent reports connection history at login.
+type ClientEvent struct {
+	Type                        int32  // 1
+	NumberDiscardedEvents       uint32 // 100
+	NetworkType                 int32  // 200
+	TimeConnectionStartedMs     uint64 // 300
+	TimeConnectionEndedMs       uint64 // 301
+	ErrorCode                   int32  // 302
+	TimeConnectionEstablishedMs uint64 // 400
+}
+
+func (m *ClientEvent) Marshal() []byte {
+	var w protoWriter
+	w.int32(1, m.Type)
+	w.varint(100, uint64(m.NumberDiscardedEvents))
+	w.int32(200, m.NetworkType)
+	w.varint(300, m.TimeConnectionStartedMs)
+	w.varint(301, m.TimeConnectionEndedMs)
+	w.int32(302, m.ErrorCode)
+	w.varint(400, m.TimeConnectionEstablishedMs)
+	return w
+}
+
+func (m *ClientEvent) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = ClientEvent{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.Type = f.i32()
+		case 100:
+			m.NumberDiscardedEvents = uint32(f.u64())
+		case 200:
+			m.NetworkType = f.i32()
+		case 300:
+			m.TimeConnectionStartedMs = f.u64()
+		case 301:
+			m.TimeConnectionEndedMs = f.u64()
+		case 302:
+			m.ErrorCode = f.i32()
+		case 400:
+			m.TimeConnectionEstablishedMs = f.u64()
+		}
+	}
+	return nil
+}
+
+// AppData is a key-value pair from a DataMessageStanza.
+type AppData struct {
+	Key   string // 1
+	Value string // 2
+}
+
+func (m *AppData) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.Key)
+	w.reqString(2, m.Value)
+	return w
+}
+
+func (m *AppData) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = AppData{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.Key = f.str()
+		case 2:
+			m.Value = f.str()
+		}
+	}
+	return nil
+}
+
+// SelectiveAck acknowledges persistent IDs; sent as IQ extension 12.
+type SelectiveAck struct {
+	IDs []string // 1
+}
+
+func (m *SelectiveAck) Marshal() []byte {
+	var w protoWriter
+	w.strings(1, m.IDs)
+	return w
+}
+
+func (m *SelectiveAck) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = SelectiveAck{}
+	for _, f := range fields {
+		if f.fieldNum == 1 {
+			m.IDs = append(m.IDs, f.str())
+		}
+	}
+	return nil
+}
+
+// StreamAck acknowledges everything up to the enclosing stanza's
+// last_stream_id_received; sent as IQ extension 13. It has no fields.
+type StreamAck struct{}
+
+func (m *StreamAck) Marshal() []byte { return nil }
+
+func (m *StreamAck) Unmarshal(data []byte) error {
+	_, err := decodeProtoFields(data)
+	return err
+}
+
+// IQ extension IDs.
+const (
+	ExtensionSelectiveAck = 12
+	ExtensionStreamAck    = 13
+)
+
+func boolVarint(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// --- Stanzas ---
+
+// HeartbeatPing (tag 0).
+type HeartbeatPing struct {
+	StreamID             int32 // 1
+	LastStreamIDReceived int32 // 2
+	Status               int64 // 3, always sent
+}
+
+func (*HeartbeatPing) Tag() byte { return TagHeartbeatPing }
+
+func (m *HeartbeatPing) Marshal() []byte {
+	var w protoWriter
+	w.int32(1, m.StreamID)
+	w.int32(2, m.LastStreamIDReceived)
+	w.reqVarint(3, uint64(m.Status))
+	return w
+}
+
+func (m *HeartbeatPing) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = HeartbeatPing{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.StreamID = f.i32()
+		case 2:
+			m.LastStreamIDReceived = f.i32()
+		case 3:
+			m.Status = f.i64()
+		}
+	}
+	return nil
+}
+
+// HeartbeatAck (tag 1); same fields as HeartbeatPing.
+type HeartbeatAck struct {
+	StreamID             int32 // 1
+	LastStreamIDReceived int32 // 2
+	Status               int64 // 3, always sent
+}
+
+func (*HeartbeatAck) Tag() byte { return TagHeartbeatAck }
+
+func (m *HeartbeatAck) Marshal() []byte {
+	return (*HeartbeatPing)(m).Marshal()
+}
+
+func (m *HeartbeatAck) Unmarshal(data []byte) error {
+	return (*HeartbeatPing)(m).Unmarshal(data)
+}
+
+// LoginRequest (tag 2).
+type LoginRequest struct {
+	ID                    string         // 1
+	Domain                string         // 2
+	User                  string         // 3
+	Resource              string         // 4
+	AuthToken             string         // 5
+	DeviceID              string         // 6
+	LastRmqID             int64          // 7
+	Settings              []Setting      // 8
+	Compress              int32          // 9
+	ReceivedPersistentIDs []string       // 10
+	AdaptiveHeartbeat     bool           // 12
+	HeartbeatStat         *HeartbeatStat // 13
+	UseRmq2               bool           // 14
+	AccountID             int64          // 15
+	AuthService           int32          // 16 — 2 = ANDROID_ID
+	NetworkType           int32          // 17 — 1 = WiFi
+	Status                int64          // 18
+	ClientEvents          []ClientEvent  // 22
+}
+
+func (*LoginRequest) Tag() byte { return TagLoginRequest }
+
+func (m *LoginRequest) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.ID)
+	w.reqString(2, m.Domain)
+	w.reqString(3, m.User)
+	w.reqString(4, m.Resource)
+	w.reqString(5, m.AuthToken)
+	w.string(6, m.DeviceID)
+	w.int64(7, m.LastRmqID)
+	for i := range m.Settings {
+		w.message(8, &m.Settings[i])
+	}
+	w.int32(9, m.Compress)
+	w.strings(10, m.ReceivedPersistentIDs)
+	w.bool(12, m.AdaptiveHeartbeat)
+	if m.HeartbeatStat != nil {
+		w.message(13, m.HeartbeatStat)
+	}
+	w.bool(14, m.UseRmq2)
+	w.int64(15, m.AccountID)
+	w.int32(16, m.AuthService)
+	w.int32(17, m.NetworkType)
+	w.int64(18, m.Status)
+	for i := range m.ClientEvents {
+		w.message(22, &m.ClientEvents[i])
+	}
+	return w
+}
+
+func (m *LoginRequest) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = LoginRequest{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.ID = f.str()
+		case 2:
+			m.Domain = f.str()
+		case 3:
+			m.User = f.str()
+		case 4:
+			m.Resource = f.str()
+		case 5:
+			m.AuthToken = f.str()
+		case 6:
+			m.DeviceID = f.str()
+		case 7:
+			m.LastRmqID = f.i64()
+		case 8:
+			s, err := sub[Setting](f)
+			if err != nil {
+				return err
+			}
+			m.Settings = append(m.Settings, *s)
+		case 9:
+			m.Compress = f.i32()
+		case 10:
+			m.ReceivedPersistentIDs = append(m.ReceivedPersistentIDs, f.str())
+		case 12:
+			m.AdaptiveHeartbeat = f.boolean()
+		case 13:
+			if m.HeartbeatStat, err = sub[HeartbeatStat](f); err != nil {
+				return err
+			}
+		case 14:
+			m.UseRmq2 = f.boolean()
+		case 15:
+			m.AccountID = f.i64()
+		case 16:
+			m.AuthService = f.i32()
+		case 17:
+			m.NetworkType = f.i32()
+		case 18:
+			m.Status = f.i64()
+		case 22:
+			e, err := sub[ClientEvent](f)
+			if err != nil {
+				return err
+			}
+			m.ClientEvents = append(m.ClientEvents, *e)
+		}
+	}
+	return nil
+}
+
+// LoginResponse (tag 3).
+type LoginResponse struct {
+	ID                   string           // 1
+	JID                  string           // 2
+	Error                *ErrorInfo       // 3 — nil on success
+	Settings             []Setting        // 4
+	StreamID             int32            // 5
+	LastStreamIDReceived int32            // 6
+	HeartbeatConfig      *HeartbeatConfig // 7 — nil if the server sent none
+	ServerTimestamp      int64            // 8
+}
+
+func (*LoginResponse) Tag() byte { return TagLoginResponse }
+
+func (m *LoginResponse) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.ID)
+	w.string(2, m.JID)
+	if m.Error != nil {
+		w.message(3, m.Error)
+	}
+	for i := range m.Settings {
+		w.message(4, &m.Settings[i])
+	}
+	w.int32(5, m.StreamID)
+	w.int32(6, m.LastStreamIDReceived)
+	if m.HeartbeatConfig != nil {
+		w.message(7, m.HeartbeatConfig)
+	}
+	w.int64(8, m.ServerTimestamp)
+	return w
+}
+
+func (m *LoginResponse) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = LoginResponse{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.ID = f.str()
+		case 2:
+			m.JID = f.str()
+		case 3:
+			if m.Error, err = sub[ErrorInfo](f); err != nil {
+				return err
+			}
+		case 4:
+			s, err := sub[Setting](f)
+			if err != nil {
+				return err
+			}
+			m.Settings = append(m.Settings, *s)
+		case 5:
+			m.StreamID = f.i32()
+		case 6:
+			m.LastStreamIDReceived = f.i32()
+		case 7:
+			if m.HeartbeatConfig, err = sub[HeartbeatConfig](f); err != nil {
+				return err
+			}
+		case 8:
+			m.ServerTimestamp = f.i64()
+		}
+	}
+	return nil
+}
+
+// Close (tag 4) asks the peer to close the connection. It has no fields.
+type Close struct{}
+
+func (*Close) Tag() byte       { return TagClose }
+func (*Close) Marshal() []byte { return nil }
+func (m *Close) Unmarshal(data []byte) error {
+	_, err := decodeProtoFields(data)
+	return err
+}
+
+// MessageStanza (tag 5) is the legacy chat message.
+type MessageStanza struct {
+	RmqID                int64       // 1
+	Type                 int32       // 2
+	ID                   string      // 3
+	From                 string      // 4
+	To                   string      // 5
+	Subject              string      // 6
+	Body                 string      // 7
+	Thread               string      // 8
+	Error                *ErrorInfo  // 9
+	Extensions           []Extension // 10
+	NoSave               bool        // 11
+	Timestamp            int64       // 12
+	PersistentID         string      // 13
+	StreamID             int32       // 14
+	LastStreamIDReceived int32       // 15
+	Read                 bool        // 16
+	AccountID            int64       // 17
+}
+
+func (*MessageStanza) Tag() byte { return TagMessageStanza }
+
+func (m *MessageStanza) Marshal() []byte {
+	var w protoWriter
+	w.int64(1, m.RmqID)
+	w.int32(2, m.Type)
+	w.string(3, m.ID)
+	w.string(4, m.From)
+	w.string(5, m.To)
+	w.string(6, m.Subject)
+	w.string(7, m.Body)
+	w.string(8, m.Thread)
+	if m.Error != nil {
+		w.message(9, m.Error)
+	}
+	for i := range m.Extensions {
+		w.message(10, &m.Extensions[i])
+	}
+	w.bool(11, m.NoSave)
+	w.int64(12, m.Timestamp)
+	w.string(13, m.PersistentID)
+	w.int32(14, m.StreamID)
+	w.int32(15, m.LastStreamIDReceived)
+	w.bool(16, m.Read)
+	w.int64(17, m.AccountID)
+	return w
+}
+
+func (m *MessageStanza) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = MessageStanza{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.RmqID = f.i64()
+		case 2:
+			m.Type = f.i32()
+		case 3:
+			m.ID = f.str()
+		case 4:
+			m.From = f.str()
+		case 5:
+			m.To = f.str()
+		case 6:
+			m.Subject = f.str()
+		case 7:
+			m.Body = f.str()
+		case 8:
+			m.Thread = f.str()
+		case 9:
+			if m.Error, err = sub[ErrorInfo](f); err != nil {
+				return err
+			}
+		case 10:
+			e, err := sub[Extension](f)
+			if err != nil {
+				return err
+			}
+			m.Extensions = append(m.Extensions, *e)
+		case 11:
+			m.NoSave = f.boolean()
+		case 12:
+			m.Timestamp = f.i64()
+		case 13:
+			m.PersistentID = f.str()
+		case 14:
+			m.StreamID = f.i32()
+		case 15:
+			m.LastStreamIDReceived = f.i32()
+		case 16:
+			m.Read = f.boolean()
+		case 17:
+			m.AccountID = f.i64()
+		}
+	}
+	return nil
+}
+
+// PresenceStanza (tag 6).
+type PresenceStanza struct {
+	RmqID                int64       // 1
+	ID                   string      // 2
+	From                 string      // 3
+	To                   string      // 4
+	Type                 int32       // 5
+	Show                 int32       // 6
+	Status               string      // 7
+	Priority             int32       // 8
+	Error                *ErrorInfo  // 9
+	Extensions           []Extension // 10
+	Client               int32       // 11
+	AvatarHash           string      // 12
+	PersistentID         string      // 13
+	StreamID             int32       // 14
+	LastStreamIDReceived int32       // 15
+	CapabilitiesFlags    int32       // 16
+	AccountID            int64       // 17
+}
+
+func (*PresenceStanza) Tag() byte { return TagPresenceStanza }
+
+func (m *PresenceStanza) Marshal() []byte {
+	var w protoWriter
+	w.int64(1, m.RmqID)
+	w.string(2, m.ID)
+	w.string(3, m.From)
+	w.string(4, m.To)
+	w.int32(5, m.Type)
+	w.int32(6, m.Show)
+	w.string(7, m.Status)
+	w.int32(8, m.Priority)
+	if m.Error != nil {
+		w.message(9, m.Error)
+	}
+	for i := range m.Extensions {
+		w.message(10, &m.Extensions[i])
+	}
+	w.int32(11, m.Client)
+	w.string(12, m.AvatarHash)
+	w.string(13, m.PersistentID)
+	w.int32(14, m.StreamID)
+	w.int32(15, m.LastStreamIDReceived)
+	w.int32(16, m.CapabilitiesFlags)
+	w.int64(17, m.AccountID)
+	return w
+}
+
+func (m *PresenceStanza) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = PresenceStanza{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.RmqID = f.i64()
+		case 2:
+			m.ID = f.str()
+		case 3:
+			m.From = f.str()
+		case 4:
+			m.To = f.str()
+		case 5:
+			m.Type = f.i32()
+		case 6:
+			m.Show = f.i32()
+		case 7:
+			m.Status = f.str()
+		case 8:
+			m.Priority = f.i32()
+		case 9:
+			if m.Error, err = sub[ErrorInfo](f); err != nil {
+				return err
+			}
+		case 10:
+			e, err := sub[Extension](f)
+			if err != nil {
+				return err
+			}
+			m.Extensions = append(m.Extensions, *e)
+		case 11:
+			m.Client = f.i32()
+		case 12:
+			m.AvatarHash = f.str()
+		case 13:
+			m.PersistentID = f.str()
+		case 14:
+			m.StreamID = f.i32()
+		case 15:
+			m.LastStreamIDReceived = f.i32()
+		case 16:
+			m.CapabilitiesFlags = f.i32()
+		case 17:
+			m.AccountID = f.i64()
+		}
+	}
+	return nil
+}
+
+// IQ stanza types.
+const (
+	IqGet    = 0
+	IqSet    = 1
+	IqResult = 2
+	IqError  = 3
+)
+
+// IqStanza (tag 7).
+type IqStanza struct {
+	RmqID                int64      // 1
+	Type                 int32      // 2 — IqGet, IqSet, IqResult, IqError
+	ID                   string     // 3
+	From                 string     // 4
+	To                   string     // 5
+	Error                *ErrorInfo // 6
+	Extension            *Extension // 7
+	PersistentID         string     // 8
+	StreamID             int32      // 9
+	LastStreamIDReceived int32      // 10
+	AccountID            int64      // 11
+	Status               int64      // 12
+}
+
+func (*IqStanza) Tag() byte { return TagIqStanza }
+
+func (m *IqStanza) Marshal() []byte {
+	var w protoWriter
+	w.int64(1, m.RmqID)
+	w.reqVarint(2, uint64(int64(m.Type)))
+	w.reqString(3, m.ID)
+	w.string(4, m.From)
+	w.string(5, m.To)
+	if m.Error != nil {
+		w.message(6, m.Error)
+	}
+	if m.Extension != nil {
+		w.message(7, m.Extension)
+	}
+	w.string(8, m.PersistentID)
+	w.int32(9, m.StreamID)
+	w.int32(10, m.LastStreamIDReceived)
+	w.int64(11, m.AccountID)
+	w.int64(12, m.Status)
+	return w
+}
+
+func (m *IqStanza) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = IqStanza{Type: -1}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.RmqID = f.i64()
+		case 2:
+			m.Type = f.i32()
+		case 3:
+			m.ID = f.str()
+		case 4:
+			m.From = f.str()
+		case 5:
+			m.To = f.str()
+		case 6:
+			if m.Error, err = sub[ErrorInfo](f); err != nil {
+				return err
+			}
+		case 7:
+			if m.Extension, err = sub[Extension](f); err != nil {
+				return err
+			}
+		case 8:
+			m.PersistentID = f.str()
+		case 9:
+			m.StreamID = f.i32()
+		case 10:
+			m.LastStreamIDReceived = f.i32()
+		case 11:
+			m.AccountID = f.i64()
+		case 12:
+			m.Status = f.i64()
+		}
+	}
+	return nil
+}
+
+// DataMessage is DataMessageStanza (tag 8), a push message.
+type DataMessage struct {
+	ID                   string    // 2
+	From                 string    // 3
+	To                   string    // 4
+	Category             string    // 5
+	Token                string    // 6
+	AppDataList          []AppData // 7
+	FromTrustedServer    bool      // 8
+	PersistentID         string    // 9
+	StreamID             int32     // 10
+	LastStreamIDReceived int32     // 11
+	RegID                string    // 13
+	DeviceUserID         int64     // 16
+	TTL                  int32     // 17
+	Sent                 int64     // 18
+	Queued               int32     // 19
+	Status               int64     // 20
+	RawData              []byte    // 21 — binary web push body
+	ImmediateAck         bool      // 24
+}
+
+func (*DataMessage) Tag() byte { return TagDataMessageStanza }
+
+func (m *DataMessage) Marshal() []byte {
+	var w protoWriter
+	w.string(2, m.ID)
+	w.reqString(3, m.From)
+	w.string(4, m.To)
+	w.reqString(5, m.Category)
+	w.string(6, m.Token)
+	for i := range m.AppDataList {
+		w.message(7, &m.AppDataList[i])
+	}
+	w.bool(8, m.FromTrustedServer)
+	w.string(9, m.PersistentID)
+	w.int32(10, m.StreamID)
+	w.int32(11, m.LastStreamIDReceived)
+	w.string(13, m.RegID)
+	w.int64(16, m.DeviceUserID)
+	w.int32(17, m.TTL)
+	w.int64(18, m.Sent)
+	w.int32(19, m.Queued)
+	w.int64(20, m.Status)
+	w.bytes(21, m.RawData)
+	w.bool(24, m.ImmediateAck)
+	return w
+}
+
+func (m *DataMessage) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = DataMessage{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 2:
+			m.ID = f.str()
+		case 3:
+			m.From = f.str()
+		case 4:
+			m.To = f.str()
+		case 5:
+			m.Category = f.str()
+		case 6:
+			m.Token = f.str()
+		case 7:
+			kv, err := sub[AppData](f)
+			if err != nil {
+				return err
+			}
+			m.AppDataList = append(m.AppDataList, *kv)
+		case 8:
+			m.FromTrustedServer = f.boolean()
+		case 9:
+			m.PersistentID = f.str()
+		case 10:
+			m.StreamID = f.i32()
+		case 11:
+			m.LastStreamIDReceived = f.i32()
+		case 13:
+			m.RegID = f.str()
+		case 16:
+			m.DeviceUserID = f.i64()
+		case 17:
+			m.TTL = f.i32()
+		case 18:
+			m.Sent = f.i64()
+		case 19:
+			m.Queued = f.i32()
+		case 20:
+			m.Status = f.i64()
+		case 21:
+			m.RawData = f.raw()
+		case 24:
+			m.ImmediateAck = f.boolean()
+		}
+	}
+	return nil
+}
+
+// BatchPresenceStanza (tag 9).
+type BatchPresenceStanza struct {
+	ID       string           // 1
+	To       string           // 2
+	Presence []PresenceStanza // 3
+	Error    *ErrorInfo       // 4
+	Type     int32            // 5
+}
+
+func (*BatchPresenceStanza) Tag() byte { return TagBatchPresence }
+
+func (m *BatchPresenceStanza) Marshal() []byte {
+	var w protoWriter
+	w.string(1, m.ID)
+	w.string(2, m.To)
+	for i := range m.Presence {
+		w.message(3, &m.Presence[i])
+	}
+	if m.Error != nil {
+		w.message(4, m.Error)
+	}
+	w.int32(5, m.Type)
+	return w
+}
+
+func (m *BatchPresenceStanza) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = BatchPresenceStanza{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.ID = f.str()
+		case 2:
+			m.To = f.str()
+		case 3:
+			p, err := sub[PresenceStanza](f)
+			if err != nil {
+				return err
+			}
+			m.Presence = append(m.Presence, *p)
+		case 4:
+			if m.Error, err = sub[ErrorInfo](f); err != nil {
+				return err
+			}
+		case 5:
+			m.Type = f.i32()
+		}
+	}
+	return nil
+}
+
+// StreamErrorStanza (tag 10) precedes the server dropping the stream.
+type StreamErrorStanza struct {
+	Type string // 1
+	Text string // 2
+}
+
+func (*StreamErrorStanza) Tag() byte { return TagStreamError }
+
+func (e *StreamErrorStanza) Error() string {
+	return fmt.Sprintf("mcs stream error %s: %s", e.Type, e.Text)
+}
+
+func (m *StreamErrorStanza) Marshal() []byte {
+	var w protoWriter
+	w.reqString(1, m.Type)
+	w.string(2, m.Text)
+	return w
+}
+
+func (m *StreamErrorStanza) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = StreamErrorStanza{}
+	for _, f := range fields {
+		switch f.fieldNum {
+		case 1:
+			m.Type = f.str()
+		case 2:
+			m.Text = f.str()
+		}
+	}
+	return nil
+}
+
+// TalkMetadata (tag 15).
+type TalkMetadata struct {
+	Foreground bool // 1
+}
+
+func (*TalkMetadata) Tag() byte { return TagTalkMetadata }
+
+func (m *TalkMetadata) Marshal() []byte {
+	var w protoWriter
+	w.bool(1, m.Foreground)
+	return w
+}
+
+func (m *TalkMetadata) Unmarshal(data []byte) error {
+	fields, err := decodeProtoFields(data)
+	if err != nil {
+		return err
+	}
+	*m = TalkMetadata{}
+	for _, f := range fields {
+		if f.fieldNum == 1 {
+			m.Foreground = f.boolean()
+		}
+	}
+	return nil
+}
+
+// RawStanza holds a stanza whose tag has no typed definition.
+type RawStanza struct {
+	tag  byte
+	Body []byte
+}
+
+func (m *RawStanza) Tag() byte       { return m.tag }
+func (m *RawStanza) Marshal() []byte { return m.Body }
+
+func (m *RawStanza) Unmarshal(data []byte) error {
+	m.Body = append([]byte(nil), data...)
+	return nil
+}
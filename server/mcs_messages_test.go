@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeStream reads every framed stanza out of stream, which starts with the
+// version byte like a connection does.
+func decodeStream(t *testing.T, stream []byte) []Stanza {
+	t.Helper()
+	r := NewMCSReader()
+	r.Feed(stream)
+	var stanzas []Stanza
+	for msg := r.Next(); msg != nil; msg = r.Next() {
+		s, err := DecodeStanza(msg)
+		if err != nil {
+			t.Fatalf("tag %d: %v", msg.Tag, err)
+		}
+		stanzas = append(stanzas, s)
+	}
+	return stanzas
+}
+
+var testError = &ErrorInfo{Code: -1, Message: "denied", Type: "auth", Extension: &Extension{ID: 7, Data: []byte{0, 1, 2}}}
+
+var testPresence = PresenceStanza{
+	RmqID: 1, ID: "p1", From: "a@b", To: "c@d", Type: 2, Show: 3, Status: "away",
+	Priority: -5, Error: testError, Extensions: []Extension{{ID: 1, Data: []byte("x")}, {ID: 2}},
+	Client: 4, AvatarHash: "f00", PersistentID: "0:1%2", StreamID: 9, LastStreamIDReceived: 8,
+	CapabilitiesFlags: 16, AccountID: 1 << 40,
+}
+
+// stanzaCases has one populated stanza per MCS tag.
+var stanzaCases = []struct {
+	name   string
+	stanza Stanza
+}{
+	{"HeartbeatPing", &HeartbeatPing{StreamID: 5, LastStreamIDReceived: 4, Status: 2}},
+	{"HeartbeatPing/zero", &HeartbeatPing{}},
+	{"HeartbeatAck", &HeartbeatAck{StreamID: 6, LastStreamIDReceived: 5, Status: 1}},
+	{"LoginRequest", &LoginRequest{
+		ID: "chrome-63.0.3234.0", Domain: "mcs.android.com", User: "42", Resource: "42",
+		AuthToken: "99", DeviceID: "android-2a", LastRmqID: 17,
+		Settings:              []Setting{{Name: "new_vc", Value: "1"}, {Name: "gtalk_rmq2", Value: "1"}},
+		Compress:              1,
+		ReceivedPersistentIDs: []string{"0:1%a", "0:2%b", "0:3%c"},
+		AdaptiveHeartbeat:     true,
+		HeartbeatStat:         &HeartbeatStat{IP: "wifi:10.0.0.2", Timeout: true, IntervalMs: 60000},
+		UseRmq2:               true, AccountID: 1000, AuthService: 2, NetworkType: 1, Status: 3,
+		ClientEvents: []ClientEvent{
+			{Type: 1, NumberDiscardedEvents: 2, NetworkType: 1, TimeConnectionStartedMs: 100, TimeConnectionEndedMs: 200, ErrorCode: -3, TimeConnectionEstablishedMs: 150},
+			{Type: 2},
+		},
+	}},
+	{"LoginResponse", &LoginResponse{
+		ID: "chrome-63.0.3234.0", JID: "42@mcs.android.com/42", Error: testError,
+		Settings: []Setting{{Name: "hb", Value: "1"}}, StreamID: 1, LastStreamIDReceived: 1,
+		HeartbeatConfig: &HeartbeatConfig{UploadStat: true, IP: "10.0.0.1", IntervalMs: 1200000},
+		ServerTimestamp: 1697800000123,
+	}},
+	{"Close", &Close{}},
+	{"MessageStanza", &MessageStanza{
+		RmqID: 3, Type: 1, ID: "m1", From: "a", To: "b", Subject: "s", Body: "hello", Thread: "t",
+		Error: testError, Extensions: []Extension{{ID: 12, Data: []byte("ext")}}, NoSave: true,
+		Timestamp: 1697800000, PersistentID: "0:4%d", StreamID: 7, LastStreamIDReceived: 6,
+		Read: true, AccountID: 5,
+	}},
+	{"PresenceStanza", &testPresence},
+	{"IqStanza", &IqStanza{
+		RmqID: 2, Type: IqSet, ID: "iq1", From: "a", To: "b", Error: testError,
+		Extension:    &Extension{ID: ExtensionSelectiveAck, Data: (&SelectiveAck{IDs: []string{"0:1%a", "0:2%b"}}).Marshal()},
+		PersistentID: "0:5%e", StreamID: 3, LastStreamIDReceived: 2, AccountID: 9, Status: 1,
+	}},
+	{"DataMessage", &DataMessage{
+		ID: "4A6C8F2E", From: "123456789012", To: "42", Category: "org.chromium.linux", Token: "tok",
+		AppDataList:       []AppData{{Key: "type", Value: "weather_alert"}, {Key: "d", Value: "AAECAw=="}},
+		FromTrustedServer: true, PersistentID: "0:6%f", StreamID: 10, LastStreamIDReceived: 9,
+		RegID: "reg", DeviceUserID: 1, TTL: 2419200, Sent: 1697800000456, Queued: 3, Status: 4,
+		RawData: []byte{0xde, 0xad, 0xbe, 0xef}, ImmediateAck: true,
+	}},
+	{"BatchPresenceStanza", &BatchPresenceStanza{
+		ID: "b1", To: "c@d", Presence: []PresenceStanza{testPresence, {ID: "p2", Type: 1}},
+		Error: testError, Type: 2,
+	}},
+	{"StreamErrorStanza", &StreamErrorStanza{Type: "conflict", Text: "replaced by new connection"}},
+	{"HttpRequest", &RawStanza{tag: TagHTTPRequest, Body: []byte{0x0a, 0x01, 'x'}}},
+	{"HttpResponse", &RawStanza{tag: TagHTTPResponse, Body: []byte{0x08, 0x01}}},
+	{"BindAccountRequest", &RawStanza{tag: TagBindAccountReq, Body: []byte{0x12, 0x00}}},
+	{"BindAccountResponse", &RawStanza{tag: TagBindAccountResp, Body: []byte{0x18, 0x7f}}},
+	{"TalkMetadata", &TalkMetadata{Foreground: true}},
+}
+
+func TestStanzaRoundTrip(t *testing.T) {
+	for _, tc := range stanzaCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodeStream(t, EncodeStanza(tc.stanza, true))
+			if len(got) != 1 {
+				t.Fatalf("decoded %d stanzas, want 1", len(got))
+			}
+			if !reflect.DeepEqual(got[0], tc.stanza) {
+				t.Errorf("round trip:\n got %#v\nwant %#v", got[0], tc.stanza)
+			}
+		})
+	}
+}
+
+// TestStanzaStream decodes every stanza from one stream fed a byte at a
+// time, as reads off a slow connection would deliver it.
+func TestStanzaStream(t *testing.T) {
+	var stream []byte
+	for i, tc := range stanzaCases {
+		stream = append(stream, EncodeStanza(tc.stanza, i == 0)...)
+	}
+	r := NewMCSReader()
+	var got []Stanza
+	for _, b := range stream {
+		r.Feed([]byte{b})
+		for msg := r.Next(); msg != nil; msg = r.Next() {
+			s, err := DecodeStanza(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, s)
+		}
+	}
+	if len(got) != len(stanzaCases) {
+		t.Fatalf("decoded %d stanzas, want %d", len(got), len(stanzaCases))
+	}
+	for i, tc := range stanzaCases {
+		if !reflect.DeepEqual(got[i], tc.stanza) {
+			t.Errorf("%s: got %#v", tc.name, got[i])
+		}
+	}
+}
+
+func TestSubmessageRoundTrip(t *testing.T) {
+	for _, m := range []interface {
+		Marshal() []byte
+		Unmarshal([]byte) error
+	}{
+		&Setting{Name: "new_vc", Value: "1"},
+		&Extension{ID: 12, Data: []byte{1, 2, 3}},
+		testError,
+		&HeartbeatStat{IP: "wifi:10.0.0.2", Timeout: true, IntervalMs: 300000},
+		&HeartbeatConfig{UploadStat: true, IP: "10.0.0.1", IntervalMs: 1200000},
+		&ClientEvent{Type: 1, NumberDiscardedEvents: 2, NetworkType: 1, TimeConnectionStartedMs: 3, TimeConnectionEndedMs: 4, ErrorCode: 5, TimeConnectionEstablishedMs: 6},
+		&AppData{Key: "d", Value: "AAECAw=="},
+		&SelectiveAck{IDs: []string{"0:1%a", "0:2%b", "0:3%c"}},
+	} {
+		got := reflect.New(reflect.TypeOf(m).Elem()).Interface().(interface{ Unmarshal([]byte) error })
+		if err := got.Unmarshal(m.Marshal()); err != nil {
+			t.Errorf("%T: %v", m, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%T round trip:\n got %#v\nwant %#v", m, got, m)
+		}
+	}
+}
+
+// TestReceivedPersistentIDs checks that each ID goes out as its own field 10,
+// as the server expects of a repeated string.
+func TestReceivedPersistentIDs(t *testing.T) {
+	ids := []string{"0:1%a", "0:2%b", "0:3%c"}
+	fields, err := decodeProtoFields(NewLoginRequest(42, 99, ids).Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fields {
+		if f.fieldNum == 10 {
+			got = append(got, f.str())
+		}
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("field 10 = %q, want %q", got, ids)
+	}
+}
+
+// serverStream is the start of a session as the server sends it: the
+// version byte, a LoginResponse and a data message, encoded by hand.
+var serverStream = strings.Join([]string{
+	"29",   // version 41
+	"0325", // LoginResponse, 37 bytes
+	"0a126368726f6d652d36332e302e333233342e30", // id "chrome-63.0.3234.0"
+	"2801",                         // stream_id 1
+	"3001",                         // last_stream_id_received 1
+	"3a0418809f49",                 // heartbeat_config { interval_ms 1200000 }
+	"40fba490e6b431",               // server_timestamp 1697800000123
+	"088301",                       // DataMessageStanza, 131 bytes
+	"12083441364338463245",         // id "4A6C8F2E"
+	"1a0c313233343536373839303132", // from "123456789012"
+	"2a126f72672e6368726f6d69756d2e6c696e7578",                                   // category "org.chromium.linux"
+	"3a150a0474797065120d776561746865725f616c657274",                             // app_data { "type": "weather_alert" }
+	"3a0d0a016412084141454341773d3d",                                             // app_data { "d": "AAECAw==" }
+	"4a23303a313639373830303030303435363738392537303331623265366639666437656364", // persistent_id
+	"5003",             // stream_id 3
+	"5802",             // last_stream_id_received 2
+	"9001c8a790e6b431", // sent 1697800000456
+}, "")
+
+func TestDecodeServerStream(t *testing.T) {
+	stream, err := hex.DecodeString(serverStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeStream(t, stream)
+	want := []Stanza{
+		&LoginResponse{
+			ID: "chrome-63.0.3234.0", StreamID: 1, LastStreamIDReceived: 1,
+			HeartbeatConfig: &HeartbeatConfig{IntervalMs: 1200000}, ServerTimestamp: 1697800000123,
+		},
+		&DataMessage{
+			ID: "4A6C8F2E", From: "123456789012", Category: "org.chromium.linux",
+			AppDataList:  []AppData{{Key: "type", Value: "weather_alert"}, {Key: "d", Value: "AAECAw=="}},
+			PersistentID: "0:1697800000456789%7031b2e6f9fd7ecd", StreamID: 3, LastStreamIDReceived: 2,
+			Sent: 1697800000456,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded:\n got %#v\nwant %#v", got, want)
+	}
+	if d := got[1].(*DataMessage).GetAppDataValue("d"); d != "AAECAw==" {
+		t.Errorf(`app data "d" = %q`, d)
+	}
+}
@@ -14,8 +14,17 @@ const (
 	TagLoginRequest      = 2
 	TagLoginResponse     = 3
 	TagClose             = 4
+	TagMessageStanza     = 5
+	TagPresenceStanza    = 6
 	TagIqStanza          = 7
 	TagDataMessageStanza = 8
+	TagBatchPresence     = 9
+	TagStreamError       = 10
+	TagHTTPRequest       = 11
+	TagHTTPResponse      = 12
+	TagBindAccountReq    = 13
+	TagBindAccountResp   = 14
+	TagTalkMetadata      = 15
 )
 
 // MCS protocol version.
@@ -116,205 +125,48 @@ func decodeProtoFields(data []byte) ([]protoField, error) {
 	return fields, nil
 }
 
-// getStringField returns the first length-delimited field with the given number.
-func getStringField(fields []protoField, num uint64) string {
-	for _, f := range fields {
-		if f.fieldNum == num && f.wireType == 2 {
-			return string(f.data)
-		}
-	}
-	return ""
-}
-
-// getVarintField returns the first varint field with the given number.
-func getVarintField(fields []protoField, num uint64) (uint64, bool) {
-	for _, f := range fields {
-		if f.fieldNum == num && f.wireType == 0 {
-			return f.varint, true
-		}
-	}
-	return 0, false
-}
-
-// getRepeatedMessage returns all length-delimited fields with the given number,
-// each parsed as a sub-message.
-func getRepeatedMessage(fields []protoField, num uint64) [][]protoField {
-	var result [][]protoField
-	for _, f := range fields {
-		if f.fieldNum == num && f.wireType == 2 {
-			sub, err := decodeProtoFields(f.data)
-			if err == nil {
-				result = append(result, sub)
-			}
-		}
-	}
-	return result
-}
-
 // --- MCS Messages ---
 
-// LoginRequest builds a serialised MCS LoginRequest protobuf.
-//
-// LoginRequest proto fields (from Android MCS proto):
+// NewLoginRequest builds the LoginRequest we send at the start of a session,
+// posing as a Chrome GCM client. use_rmq2 is critical: without it the server
+// accepts the login but never delivers messages.
 //
-//	field 1 (string):          id — Chrome build identifier
-//	field 2 (string):          domain — "mcs.android.com"
-//	field 3 (string):          user — android_id as string
-//	field 4 (string):          resource — android_id as string
-//	field 5 (string):          auth_token — security_token as string
-//	field 6 (string):          device_id — "android-HEX"
-//	field 7 (int64):           last_rmq_id
-//	field 8 (repeated Setting): setting — key-value pairs
-//	field 9 (int32):           compress
-//	field 10 (repeated string): received_persistent_id
-//	field 12 (bool):           adaptive_heartbeat
-//	field 14 (bool):           use_rmq2 — CRITICAL: enables message delivery
-//	field 15 (int64):          account_id
-//	field 16 (int32):          auth_service — 2 = ANDROID_ID
-//	field 17 (int32):          network_type — 1 = WiFi
-func BuildLoginRequest(androidID, securityToken uint64) []byte {
-	hexID := fmt.Sprintf("%x", androidID)
-	clientID := "chrome-63.0.3234.0"
-	deviceID := "android-" + hexID
+// receivedPersistentIDs lists data messages we already processed, so the
+// server does not redeliver them after a reconnect.
+func NewLoginRequest(androidID, securityToken uint64, receivedPersistentIDs []string) *LoginRequest {
 	aidStr := fmt.Sprintf("%d", androidID)
-	tokenStr := fmt.Sprintf("%d", securityToken)
-
-	// Build Setting message for "new_vc" = "1"
-	var settingMsg []byte
-	settingMsg = append(settingMsg, encodeStringField(1, []byte("new_vc"))...)
-	settingMsg = append(settingMsg, encodeStringField(2, []byte("1"))...)
-
-	var msg []byte
-	msg = append(msg, encodeStringField(1, []byte(clientID))...)          // id
-	msg = append(msg, encodeStringField(2, []byte("mcs.android.com"))...) // domain
-	msg = append(msg, encodeStringField(3, []byte(aidStr))...)            // user
-	msg = append(msg, encodeStringField(4, []byte(aidStr))...)            // resource
-	msg = append(msg, encodeStringField(5, []byte(tokenStr))...)          // auth_token
-	msg = append(msg, encodeStringField(6, []byte(deviceID))...)          // device_id
-	msg = append(msg, encodeStringField(8, settingMsg)...)                // setting: new_vc=1
-	msg = append(msg, encodeVarintField(14, 1)...)                        // use_rmq2 = true
-	msg = append(msg, encodeVarintField(16, 2)...)                        // auth_service = ANDROID_ID
-	msg = append(msg, encodeVarintField(17, 1)...)                        // network_type = WiFi
-
-	return msg
-}
-
-// HeartbeatPing fields:
-//
-//	field 1 (int32): stream_id — our outgoing stream counter
-//	field 2 (int32): last_stream_id_received — last server message we received
-//	field 3 (int64): status
-func BuildHeartbeatPing(streamID, lastStreamIDReceived int) []byte {
-	var msg []byte
-	if streamID > 0 {
-		msg = append(msg, encodeVarintField(1, uint64(streamID))...)
+	return &LoginRequest{
+		ID:                    "chrome-63.0.3234.0",
+		Domain:                "mcs.android.com",
+		User:                  aidStr,
+		Resource:              aidStr,
+		AuthToken:             fmt.Sprintf("%d", securityToken),
+		DeviceID:              fmt.Sprintf("android-%x", androidID),
+		Settings:              []Setting{{Name: "new_vc", Value: "1"}},
+		ReceivedPersistentIDs: receivedPersistentIDs,
+		UseRmq2:               true,
+		AuthService:           2, // ANDROID_ID
+		NetworkType:           1, // WiFi
 	}
-	if lastStreamIDReceived > 0 {
-		msg = append(msg, encodeVarintField(2, uint64(lastStreamIDReceived))...)
-	}
-	msg = append(msg, encodeVarintField(3, 0)...) // status = 0
-	return msg
 }
 
-// HeartbeatAck is sent in response to HeartbeatPing.
-func BuildHeartbeatAck(lastStreamIDReceived int) []byte {
-	var msg []byte
-	if lastStreamIDReceived > 0 {
-		msg = append(msg, encodeVarintField(2, uint64(lastStreamIDReceived))...)
-	}
-	msg = append(msg, encodeVarintField(3, 0)...) // status = 0
-	return msg
-}
-
-// SelectiveAck acknowledges persistent IDs.
-//
-// IqStanza fields for selective ack:
-//
-//	field 2 (int32): type = 1 (SET)
-//	field 3 (string): id
-//	field 7 (message): extension (id=12, data=<SelectiveAck>)
-func BuildSelectiveAck(persistentIDs []string, iqID string) []byte {
+// NewSelectiveAck builds an IQ SET carrying a SelectiveAck extension that
+// acknowledges persistentIDs.
+func NewSelectiveAck(persistentIDs []string, iqID string) *IqStanza {
 	if iqID == "" {
 		iqID = "0"
 	}
-
-	// Build inner SelectiveAck message: field 1 (repeated string): id
-	var innerMsg []byte
-	for _, id := range persistentIDs {
-		innerMsg = append(innerMsg, encodeStringField(1, []byte(id))...)
-	}
-
-	// Build extension message: field 1 (id=12), field 2 (bytes=data)
-	var extMsg []byte
-	extMsg = append(extMsg, encodeVarintField(1, 12)...)
-	extMsg = append(extMsg, encodeStringField(2, innerMsg)...)
-
-	// Build IqStanza
-	var msg []byte
-	msg = append(msg, encodeVarintField(2, 1)...)            // type = SET
-	msg = append(msg, encodeStringField(3, []byte(iqID))...) // id
-	msg = append(msg, encodeStringField(7, extMsg)...)       // extension
-	return msg
-}
-
-// BuildIqResult builds an IqStanza response with type RESULT.
-func BuildIqResult(iqID, to, from string) []byte {
-	var msg []byte
-	msg = append(msg, encodeVarintField(2, 2)...)            // type = RESULT
-	msg = append(msg, encodeStringField(3, []byte(iqID))...) // id
-	if from != "" {
-		msg = append(msg, encodeStringField(4, []byte(from))...)
+	ack := SelectiveAck{IDs: persistentIDs}
+	return &IqStanza{
+		Type:      IqSet,
+		ID:        iqID,
+		Extension: &Extension{ID: ExtensionSelectiveAck, Data: ack.Marshal()},
 	}
-	if to != "" {
-		msg = append(msg, encodeStringField(5, []byte(to))...)
-	}
-	return msg
-}
-
-// AppData is a key-value pair from a DataMessageStanza.
-type AppData struct {
-	Key   string
-	Value string
-}
-
-// DataMessage is a parsed DataMessageStanza.
-type DataMessage struct {
-	From         string
-	Category     string
-	AppDataList  []AppData
-	PersistentID string
 }
 
-// ParseDataMessageStanza extracts fields from a DataMessageStanza protobuf.
-//
-// DataMessageStanza fields:
-//
-//	field 3 (string): from
-//	field 5 (string): category
-//	field 7 (repeated message): app_data — each has field 1 (key), field 2 (value)
-//	field 9 (string): persistent_id
-func ParseDataMessageStanza(data []byte) (*DataMessage, error) {
-	fields, err := decodeProtoFields(data)
-	if err != nil {
-		return nil, err
-	}
-
-	msg := &DataMessage{
-		From:         getStringField(fields, 3),
-		Category:     getStringField(fields, 5),
-		PersistentID: getStringField(fields, 9),
-	}
-
-	// Parse repeated app_data (field 7).
-	for _, sub := range getRepeatedMessage(fields, 7) {
-		kv := AppData{
-			Key:   getStringField(sub, 1),
-			Value: getStringField(sub, 2),
-		}
-		msg.AppDataList = append(msg.AppDataList, kv)
-	}
-
-	return msg, nil
+// Result builds the RESULT reply the server expects to an IQ GET or SET.
+func (iq *IqStanza) Result() *IqStanza {
+	return &IqStanza{Type: IqResult, ID: iq.ID, From: iq.To, To: iq.From}
 }
 
 // GetAppDataValue returns the value for a given key from a DataMessage.
@@ -327,6 +179,12 @@ func (d *DataMessage) GetAppDataValue(key string) string {
 	return ""
 }
 
+// ContentEncoding returns the web push content coding of RawData,
+// "aes128gcm" or "aesgcm"; the encryption parameters arrive as app_data.
+func (d *DataMessage) ContentEncoding() string {
+	return d.GetAppDataValue("content-encoding")
+}
+
 // --- MCS wire format ---
 
 // EncodeMCSMessage wraps a protobuf message with MCS wire framing:
@@ -0,0 +1,136 @@
+package main
+
+import "sync"
+
+const (
+	// streamAckThreshold is how many server stanzas we let go unreported
+	// before sending an explicit StreamAck, as Chrome's MCS client does.
+	streamAckThreshold = 10
+	// maxUnackedStanzas bounds the outgoing stanzas we remember; beyond it
+	// the oldest are forgotten.
+	maxUnackedStanzas = 256
+)
+
+// sentStanza is an outgoing stanza the server has not acknowledged yet.
+type sentStanza struct {
+	streamID int32
+	tag      byte
+	ackIDs   []string // persistent IDs carried, for selective acks
+}
+
+// mcsStream is the RMQ2 stream bookkeeping for one MCS connection.
+//
+// Both sides number the stanzas they send, starting at 1 with the login
+// exchange. Each stanza we send carries last_stream_id_received, the number
+// of the last server stanza we saw, which acknowledges everything up to it;
+// the server does the same for ours. We keep what we sent until the server
+// acknowledges it, so selective acks lost with a dropped connection can be
+// repeated on the next login.
+type mcsStream struct {
+	mu       sync.Mutex
+	outID    int32 // last stream ID we sent
+	inID     int32 // last stream ID we received
+	reported int32 // inID as last reported to the server
+	acked    int32 // highest of our stream IDs the server acknowledged
+	unacked  []sentStanza
+}
+
+// Reset starts a new connection and returns the persistent IDs whose
+// selective acks were never acknowledged.
+func (s *mcsStream) Reset() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []string
+	for _, st := range s.unacked {
+		pending = append(pending, st.ackIDs...)
+	}
+	s.outID, s.inID, s.reported, s.acked = 0, 0, 0, 0
+	s.unacked = nil
+	return pending
+}
+
+// Send assigns the next stream ID to an outgoing stanza and stamps it with
+// our last received stream ID. ackIDs are the persistent IDs it acknowledges,
+// if any. Callers serialise Send with the write that follows.
+func (s *mcsStream) Send(st Stanza, ackIDs []string) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outID++
+	if r, ok := st.(streamStamped); ok {
+		r.setLastStreamIDReceived(s.inID)
+		s.reported = s.inID
+	}
+	s.unacked = append(s.unacked, sentStanza{streamID: s.outID, tag: st.Tag(), ackIDs: ackIDs})
+	if len(s.unacked) > maxUnackedStanzas {
+		s.unacked = s.unacked[len(s.unacked)-maxUnackedStanzas:]
+	}
+	return s.outID
+}
+
+// Receive counts an incoming stanza and applies the acknowledgement it
+// carries. It returns the stanza's stream ID.
+func (s *mcsStream) Receive(st Stanza) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inID++
+	if r, ok := st.(streamStamped); ok {
+		s.ackUpTo(r.lastStreamIDReceived())
+	}
+	return s.inID
+}
+
+// ackUpTo drops our stanzas up to and including id. Caller holds s.mu.
+func (s *mcsStream) ackUpTo(id int32) {
+	if id <= s.acked || id > s.outID {
+		return
+	}
+	s.acked = id
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].streamID <= id {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// NeedsStreamAck reports whether enough server stanzas went unreported that
+// an explicit StreamAck is due.
+func (s *mcsStream) NeedsStreamAck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inID-s.reported >= streamAckThreshold
+}
+
+// IDs returns the last sent and last received stream IDs.
+func (s *mcsStream) IDs() (out, in int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outID, s.inID
+}
+
+// Unacked returns how many sent stanzas await acknowledgement.
+func (s *mcsStream) Unacked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.unacked)
+}
+
+// streamStamped is implemented by stanzas carrying last_stream_id_received.
+type streamStamped interface {
+	lastStreamIDReceived() int32
+	setLastStreamIDReceived(int32)
+}
+
+func (m *HeartbeatPing) lastStreamIDReceived() int32      { return m.LastStreamIDReceived }
+func (m *HeartbeatPing) setLastStreamIDReceived(v int32)  { m.LastStreamIDReceived = v }
+func (m *HeartbeatAck) lastStreamIDReceived() int32       { return m.LastStreamIDReceived }
+func (m *HeartbeatAck) setLastStreamIDReceived(v int32)   { m.LastStreamIDReceived = v }
+func (m *LoginResponse) lastStreamIDReceived() int32      { return m.LastStreamIDReceived }
+func (m *LoginResponse) setLastStreamIDReceived(v int32)  { m.LastStreamIDReceived = v }
+func (m *MessageStanza) lastStreamIDReceived() int32      { return m.LastStreamIDReceived }
+func (m *MessageStanza) setLastStreamIDReceived(v int32)  { m.LastStreamIDReceived = v }
+func (m *PresenceStanza) lastStreamIDReceived() int32     { return m.LastStreamIDReceived }
+func (m *PresenceStanza) setLastStreamIDReceived(v int32) { m.LastStreamIDReceived = v }
+func (m *IqStanza) lastStreamIDReceived() int32           { return m.LastStreamIDReceived }
+func (m *IqStanza) setLastStreamIDReceived(v int32)       { m.LastStreamIDReceived = v }
+func (m *DataMessage) lastStreamIDReceived() int32        { return m.LastStreamIDReceived }
+func (m *DataMessage) setLastStreamIDReceived(v int32)    { m.LastStreamIDReceived = v }
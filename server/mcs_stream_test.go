@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// streamStep is one stanza of a recorded session: sent when send is set,
+// received otherwise, with what the stream should look like afterwards.
+type streamStep struct {
+	send      bool
+	stanza    Stanza
+	ackIDs    []string
+	id        int32 // stream ID Send or Receive returns
+	stamp     int32 // last_stream_id_received stamped on a sent stanza
+	unacked   int
+	streamAck bool // NeedsStreamAck afterwards
+}
+
+func sent(st Stanza, ackIDs []string, id, stamp int32, unacked int) streamStep {
+	return streamStep{send: true, stanza: st, ackIDs: ackIDs, id: id, stamp: stamp, unacked: unacked}
+}
+
+func received(st Stanza, id int32, unacked int) streamStep {
+	return streamStep{stanza: st, id: id, unacked: unacked}
+}
+
+func dataFrom(persistentID string, lastReceived int32) *DataMessage {
+	return &DataMessage{PersistentID: persistentID, LastStreamIDReceived: lastReceived}
+}
+
+func replay(t *testing.T, s *mcsStream, steps []streamStep) {
+	t.Helper()
+	for i, step := range steps {
+		var id int32
+		if step.send {
+			id = s.Send(step.stanza, step.ackIDs)
+			if r, ok := step.stanza.(streamStamped); ok && r.lastStreamIDReceived() != step.stamp {
+				t.Errorf("step %d: sent %T with last_stream_id_received %d, want %d", i, step.stanza, r.lastStreamIDReceived(), step.stamp)
+			}
+		} else {
+			id = s.Receive(step.stanza)
+		}
+		if id != step.id {
+			t.Errorf("step %d: %T has stream ID %d, want %d", i, step.stanza, id, step.id)
+		}
+		if n := s.Unacked(); n != step.unacked {
+			t.Errorf("step %d: %d unacked after %T, want %d", i, n, step.stanza, step.unacked)
+		}
+		if got := s.NeedsStreamAck(); got != step.streamAck {
+			t.Errorf("step %d: NeedsStreamAck = %v after %T, want %v", i, got, step.stanza, step.streamAck)
+		}
+	}
+}
+
+func TestStreamSession(t *testing.T) {
+	var s mcsStream
+	replay(t, &s, []streamStep{
+		sent(NewLoginRequest(42, 99, nil), nil, 1, 0, 1),
+		received(&LoginResponse{LastStreamIDReceived: 1}, 1, 0),
+		received(dataFrom("0:1%a", 1), 2, 0),
+		received(dataFrom("0:2%b", 1), 3, 0),
+		sent(NewSelectiveAck([]string{"0:1%a", "0:2%b"}, "ack-2"), []string{"0:1%a", "0:2%b"}, 2, 3, 1),
+		sent(&HeartbeatPing{}, nil, 3, 3, 2),
+		// An ack older than what we already know changes nothing.
+		received(dataFrom("0:3%c", 1), 4, 2),
+		received(&HeartbeatAck{LastStreamIDReceived: 2}, 5, 1),
+		sent(&HeartbeatPing{}, nil, 4, 5, 2),
+		received(&HeartbeatAck{LastStreamIDReceived: 4}, 6, 0),
+		// Nor does one for a stanza we never sent.
+		received(&HeartbeatAck{LastStreamIDReceived: 9}, 7, 0),
+		sent(&HeartbeatPing{}, nil, 5, 7, 1),
+		// A stanza we could not decode still counts, but acks nothing.
+		received(&RawStanza{tag: TagHTTPRequest}, 8, 1),
+		received(&HeartbeatAck{LastStreamIDReceived: 5}, 9, 0),
+	})
+	if out, in := s.IDs(); out != 5 || in != 9 {
+		t.Errorf("IDs() = %d, %d, want 5, 9", out, in)
+	}
+}
+
+// TestStreamAckThreshold receives a burst of messages with nothing of ours
+// to carry the ack until a StreamAck is due.
+func TestStreamAckThreshold(t *testing.T) {
+	var s mcsStream
+	steps := []streamStep{
+		sent(NewLoginRequest(42, 99, nil), nil, 1, 0, 1),
+		received(&LoginResponse{LastStreamIDReceived: 1}, 1, 0),
+	}
+	for id := int32(2); id <= streamAckThreshold; id++ {
+		steps = append(steps, received(dataFrom("", 1), id, 0))
+	}
+	steps[len(steps)-1].streamAck = true
+	steps = append(steps,
+		sent(&IqStanza{Type: IqSet, ID: "sack-2", Extension: &Extension{ID: ExtensionStreamAck}}, nil, 2, streamAckThreshold, 1),
+		received(dataFrom("", 2), streamAckThreshold+1, 0),
+	)
+	replay(t, &s, steps)
+}
+
+func TestStreamResetRepeatsSelectiveAcks(t *testing.T) {
+	var s mcsStream
+	replay(t, &s, []streamStep{
+		sent(NewLoginRequest(42, 99, nil), nil, 1, 0, 1),
+		received(&LoginResponse{LastStreamIDReceived: 1}, 1, 0),
+		received(dataFrom("0:1%a", 1), 2, 0),
+		sent(NewSelectiveAck([]string{"0:1%a"}, "ack-2"), []string{"0:1%a"}, 2, 2, 1),
+		received(dataFrom("0:2%b", 1), 3, 1),
+		received(dataFrom("0:3%c", 1), 4, 1),
+		sent(NewSelectiveAck([]string{"0:2%b", "0:3%c"}, "ack-3"), []string{"0:2%b", "0:3%c"}, 3, 4, 2),
+		sent(&HeartbeatPing{}, nil, 4, 4, 3),
+		// The server saw the first selective ack before the connection dropped.
+		received(&HeartbeatAck{LastStreamIDReceived: 2}, 5, 2),
+	})
+
+	want := []string{"0:2%b", "0:3%c"}
+	if got := s.Reset(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Reset() = %q, want %q", got, want)
+	}
+	if out, in := s.IDs(); out != 0 || in != 0 || s.Unacked() != 0 {
+		t.Fatalf("after Reset: IDs() = %d, %d with %d unacked", out, in, s.Unacked())
+	}
+
+	// The next session starts numbering again; its login carries the IDs, and
+	// once the server acknowledges it there is nothing left to repeat.
+	replay(t, &s, []streamStep{
+		sent(NewLoginRequest(42, 99, want), nil, 1, 0, 1),
+		received(&LoginResponse{LastStreamIDReceived: 1}, 1, 0),
+	})
+	if got := s.Reset(); got != nil {
+		t.Errorf("second Reset() = %q, want nothing", got)
+	}
+}
+
+func TestStreamForgetsOldest(t *testing.T) {
+	var s mcsStream
+	for i := 0; i < maxUnackedStanzas+10; i++ {
+		s.Send(&HeartbeatPing{}, []string{string(rune('a' + i%26))})
+	}
+	if n := s.Unacked(); n != maxUnackedStanzas {
+		t.Fatalf("%d unacked, want %d", n, maxUnackedStanzas)
+	}
+	if got := s.Reset(); len(got) != maxUnackedStanzas || got[0] != "k" {
+		t.Errorf("Reset() kept %d IDs starting %q, want %d starting \"k\"", len(got), got[0], maxUnackedStanzas)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics live in a process-wide registry and are exposed in the Prometheus
+// text format on the admin listener. Counters are bumped where things
+// happen; gauges (and counters kept elsewhere, like MCS reconnects) are
+// sampled when scraped.
+var metrics = &metricsRegistry{}
+
+// Transport.
+var (
+	fcmSends           = metrics.counter("push_tunnel_fcm_sends_total", "FCM HTTP v1 sends by result.", "result")
+	webPushSends       = metrics.counter("push_tunnel_webpush_sends_total", "Web push sends by result.", "result")
+	framesSent         = metrics.counter("push_tunnel_transport_frames_sent_total", "Frames sent to peers by frame type.", "type")
+	frameBytesSent     = metrics.counter("push_tunnel_transport_sealed_bytes_sent_total", "Sealed bytes of the frames sent to peers.")
+	messagesReceived   = metrics.counter("push_tunnel_transport_messages_received_total", "Messages received over MCS, by kind (data or raw).", "kind")
+	duplicatesDropped  = metrics.counter("push_tunnel_transport_duplicates_total", "Received messages dropped as copies of one already seen.")
+	framesReceived     = metrics.counter("push_tunnel_transport_frames_received_total", "Frames received from peers by frame type.", "type")
+	receiveErrors      = metrics.counter("push_tunnel_transport_receive_errors_total", "Received messages that could not be turned into a frame, by reason.", "reason")
+	chunkGroupsExpired = metrics.counter("push_tunnel_transport_chunk_groups_expired_total", "Chunked messages dropped because not every chunk arrived in time.")
+)
+
+// Sessions and relay.
+var (
+	sessionQueueDrops = metrics.counter("push_tunnel_session_queue_drops_total", "Frames dropped because a session's downstream queue was full.", "session")
+	relayConnects     = metrics.counter("push_tunnel_relay_connects_total", "CONNECT requests by result (ok, error or refused).", "result")
+	relayBytes        = metrics.counter("push_tunnel_relay_bytes_total", "Bytes relayed to and from targets, by direction (upstream or downstream).", "direction")
+)
+
+// metricsRegistry holds every metric, in registration order.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+// counter registers a counter split by the given labels.
+func (r *metricsRegistry) counter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: metricDesc{name, help, "counter", labels}, values: make(map[string]*sample)}
+	r.register(c)
+	return c
+}
+
+// sampled registers a metric of kind ("counter" or "gauge") whose values
+// collect emits when scraped. Registering a name again replaces it.
+func (r *metricsRegistry) sampled(name, help, kind string, collect func(emit func(v float64, labelValues ...string)), labels ...string) {
+	r.register(&sampledMetric{desc: metricDesc{name, help, kind, labels}, collect: collect})
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, existing := range r.metrics {
+		if existing.metricName() == m.metricName() {
+			r.metrics[i] = m
+			return
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (r *metricsRegistry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	all := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+type metricDesc struct {
+	name, help, kind string
+	labels           []string
+}
+
+func (d metricDesc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+func (d metricDesc) writeSample(w io.Writer, v float64, labelValues []string) {
+	fmt.Fprint(w, d.name)
+	if len(d.labels) > 0 {
+		pairs := make([]string, len(d.labels))
+		for i, l := range d.labels {
+			val := ""
+			if i < len(labelValues) {
+				val = labelValues[i]
+			}
+			pairs[i] = l + `="` + labelEscaper.Replace(val) + `"`
+		}
+		fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// labelEscaper escapes a label value as the text format wants: only
+// backslash, double quote and newline.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter is a monotonically increasing count, optionally split by labels.
+type Counter struct {
+	desc metricDesc
+
+	mu     sync.Mutex
+	values map[string]*sample // by label values joined with NUL
+}
+
+// Inc adds one to the count for labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n to the count for labelValues.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		c.values[key] = s
+	}
+	s.value += n
+}
+
+// Delete drops the count for labelValues, for a label value that is gone
+// for good.
+func (c *Counter) Delete(labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+func (c *Counter) metricName() string { return c.desc.name }
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]sample, len(keys))
+	for i, k := range keys {
+		samples[i] = *c.values[k]
+	}
+	c.mu.Unlock()
+
+	c.desc.writeHeader(w)
+	if len(samples) == 0 && len(c.desc.labels) == 0 {
+		c.desc.writeSample(w, 0, nil)
+	}
+	for _, s := range samples {
+		c.desc.writeSample(w, s.value, s.labelValues)
+	}
+}
+
+// sampledMetric is read when scraped.
+type sampledMetric struct {
+	desc    metricDesc
+	collect func(emit func(v float64, labelValues ...string))
+}
+
+func (m *sampledMetric) metricName() string { return m.desc.name }
+
+func (m *sampledMetric) write(w io.Writer) {
+	m.desc.writeHeader(w)
+	m.collect(func(v float64, labelValues ...string) {
+		m.desc.writeSample(w, v, labelValues)
+	})
+}
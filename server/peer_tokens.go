@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// peerTokensFile remembers the tokens the peer announced in its last HELLO,
+// so a restarted relay can reach the client before it says hello again.
+const peerTokensFile = "peer_tokens.json"
+
+// loadPeerTokens returns the peer tokens learned in an earlier run.
+func loadPeerTokens(path string) (TokensPayload, error) {
+	var tp TokensPayload
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tp, err
+	}
+	err = json.Unmarshal(data, &tp)
+	return tp, err
+}
+
+// savePeerTokens persists the peer's tokens.
+func savePeerTokens(path string, tp TokensPayload) error {
+	data, err := json.MarshalIndent(tp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
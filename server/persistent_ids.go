@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	persistentIDsFile = "mcs_persistent_ids.txt"
+	// maxPersistentIDs bounds how many processed IDs we remember.
+	maxPersistentIDs = 1000
+	// maxLoginPersistentIDs bounds how many of them go into a LoginRequest.
+	maxLoginPersistentIDs = 100
+)
+
+// PersistentIDStore remembers the persistent IDs of recently processed MCS
+// data messages across restarts. If we crash after handling a message but
+// before FCM saw our ack, the message is redelivered; the store lets us
+// recognise and drop it, and tells the server on login what we already have.
+//
+// IDs are appended to a text file, one per line, which is compacted to the
+// newest maxPersistentIDs entries when it grows to twice that.
+type PersistentIDStore struct {
+	path string
+
+	mu    sync.Mutex
+	ids   []string // oldest first
+	set   map[string]struct{}
+	lines int // lines currently in the file
+}
+
+// OpenPersistentIDStore loads the store at path, creating it if missing.
+func OpenPersistentIDStore(path string) (*PersistentIDStore, error) {
+	s := &PersistentIDStore{
+		path: path,
+		set:  make(map[string]struct{}),
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open persistent id store: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		id := strings.TrimSpace(sc.Text())
+		if id == "" {
+			continue
+		}
+		s.lines++
+		s.remember(id)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read persistent id store: %w", err)
+	}
+	return s, nil
+}
+
+// Seen reports whether id has already been processed.
+func (s *PersistentIDStore) Seen(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.set[id]
+	return ok
+}
+
+// Add records id as processed and persists it.
+func (s *PersistentIDStore) Add(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.set[id]; ok {
+		return nil
+	}
+	s.remember(id)
+
+	if s.lines+1 > 2*maxPersistentIDs {
+		return s.compact()
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(id + "\n"); err != nil {
+		return err
+	}
+	s.lines++
+	return nil
+}
+
+// Recent returns up to n of the most recently processed IDs.
+func (s *PersistentIDStore) Recent(n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > len(s.ids) {
+		n = len(s.ids)
+	}
+	out := make([]string, n)
+	copy(out, s.ids[len(s.ids)-n:])
+	return out
+}
+
+// remember adds id to memory, evicting the oldest beyond the bound.
+// Caller holds s.mu.
+func (s *PersistentIDStore) remember(id string) {
+	if _, ok := s.set[id]; ok {
+		return
+	}
+	s.ids = append(s.ids, id)
+	s.set[id] = struct{}{}
+	if len(s.ids) > maxPersistentIDs {
+		delete(s.set, s.ids[0])
+		s.ids = s.ids[1:]
+	}
+}
+
+// compact rewrites the file with only the in-memory IDs. Caller holds s.mu.
+func (s *PersistentIDStore) compact() error {
+	tmp := s.path + ".tmp"
+	data := strings.Join(s.ids, "\n") + "\n"
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.lines = len(s.ids)
+	return nil
+}
@@ -12,8 +12,44 @@ const (
 	FrameData       byte = 0x02
 	FrameDisconnect byte = 0x03
 	FrameAck        byte = 0x04
+	// FrameTokens is a control frame on channel 0 announcing where its
+	// sender can be reached; the payload is a JSON TokensPayload.
+	FrameTokens byte = 0x05
+	// FrameHello is sent by the client to introduce itself; it carries a
+	// TokensPayload with the client's tokens and is answered with FrameTokens.
+	FrameHello byte = 0x06
+	// FrameProbe is a self-test frame a relay sends to one of its own
+	// identities; it never goes to the peer.
+	FrameProbe byte = 0x07
 )
 
+// frameTypeName names a frame type for logs and metrics.
+func frameTypeName(t byte) string {
+	switch t {
+	case FrameConnect:
+		return "connect"
+	case FrameData:
+		return "data"
+	case FrameDisconnect:
+		return "disconnect"
+	case FrameAck:
+		return "ack"
+	case FrameTokens:
+		return "tokens"
+	case FrameHello:
+		return "hello"
+	case FrameProbe:
+		return "probe"
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+// TokensPayload is the payload of a FrameTokens frame.
+type TokensPayload struct {
+	FCMTokens    []string `json:"fcm_tokens"`
+	WebPushToken string   `json:"webpush_token,omitempty"`
+}
+
 // Frame header size: 1 (type) + 2 (channel_id) + 2 (payload_length)
 const frameHeaderSize = 5
 
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -14,7 +15,8 @@ const (
 
 // RelayManager handles connecting to target hosts and reading data back.
 type RelayManager struct {
-	crypto *Crypto
+	crypto  *Crypto
+	readers sync.WaitGroup // running read loops
 }
 
 // NewRelayManager creates a new relay manager.
@@ -27,13 +29,17 @@ func NewRelayManager(c *Crypto) *RelayManager {
 func (r *RelayManager) Connect(session *Session, channelID uint16, target string) error {
 	conn, err := net.DialTimeout("tcp", target, dialTimeout)
 	if err != nil {
+		relayConnects.Inc("error")
 		return err
 	}
-	ch := &Channel{ID: channelID, Conn: conn}
+	relayConnects.Inc("ok")
+	session.usage.channels.Add(1)
+	ch := &Channel{ID: channelID, Conn: conn, Target: target, Opened: time.Now()}
 	session.AddChannel(ch)
-	log.Printf("[relay] channel %d: connected to %s", channelID, target)
+	relayLog.Info("channel connected", "session", session.DeviceID, "channel", channelID, "target", target)
 
 	// Read from target, queue downstream frames.
+	r.readers.Add(1)
 	go r.readLoop(session, ch)
 	return nil
 }
@@ -42,11 +48,16 @@ func (r *RelayManager) Connect(session *Session, channelID uint16, target string
 func (r *RelayManager) Forward(session *Session, channelID uint16, data []byte) {
 	ch := session.GetChannel(channelID)
 	if ch == nil {
-		log.Printf("[relay] channel %d: not found, dropping data", channelID)
+		relayLog.Debug("channel not found; dropping data", "session", session.DeviceID, "channel", channelID)
 		return
 	}
-	if _, err := ch.Conn.Write(data); err != nil {
-		log.Printf("[relay] channel %d: write error: %v", channelID, err)
+	n, err := ch.Conn.Write(data)
+	ch.bytesUp.Add(uint64(n))
+	ch.framesUp.Add(1)
+	session.usage.bytesUp.Add(uint64(n))
+	relayBytes.Add(float64(n), "upstream")
+	if err != nil {
+		relayLog.Info("channel write failed", "session", session.DeviceID, "channel", channelID, sensitiveErrAttr(err))
 		session.RemoveChannel(channelID)
 		session.QueueDownstream(Frame{
 			Type:      FrameDisconnect,
@@ -58,23 +69,44 @@ func (r *RelayManager) Forward(session *Session, channelID uint16, data []byte)
 // Disconnect closes a channel's connection.
 func (r *RelayManager) Disconnect(session *Session, channelID uint16) {
 	session.RemoveChannel(channelID)
-	log.Printf("[relay] channel %d: disconnected", channelID)
+	relayLog.Info("channel disconnected", "session", session.DeviceID, "channel", channelID)
+}
+
+// Wait waits until every read loop has ended and queued its DISCONNECT, or
+// ctx is done.
+func (r *RelayManager) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.readers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (r *RelayManager) readLoop(session *Session, ch *Channel) {
+	defer r.readers.Done()
 	defer func() {
 		session.RemoveChannel(ch.ID)
 		session.QueueDownstream(Frame{
 			Type:      FrameDisconnect,
 			ChannelID: ch.ID,
 		})
-		log.Printf("[relay] channel %d: read loop ended", ch.ID)
+		relayLog.Info("channel closed", "session", session.DeviceID, "channel", ch.ID)
 	}()
 
 	buf := make([]byte, readBufSize)
 	for {
 		n, err := ch.Conn.Read(buf)
 		if n > 0 {
+			ch.bytesDown.Add(uint64(n))
+			ch.framesDown.Add(1)
+			session.usage.bytesDown.Add(uint64(n))
+			relayBytes.Add(float64(n), "downstream")
 			payload := make([]byte, n)
 			copy(payload, buf[:n])
 			session.QueueDownstream(Frame{
@@ -85,7 +117,7 @@ func (r *RelayManager) readLoop(session *Session, ch *Channel) {
 		}
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("[relay] channel %d: read error: %v", ch.ID, err)
+				relayLog.Info("channel read failed", "session", session.DeviceID, "channel", ch.ID, sensitiveErrAttr(err))
 			}
 			return
 		}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+)
+
+// reloader applies a config read again on SIGHUP to the running relay.
+// Peer tokens, transport settings, the PSK, logging, the trace and the
+// invited users change live; settings only read at startup are reported as needing a restart.
+type reloader struct {
+	srv   *Server
+	state StateDir
+	boot  Config // the config the relay started with
+	cfg   Config // the config last applied
+
+	// Set when FCM is configured.
+	router  *keyRouter
+	tokens  *TokenManager
+	users   map[string]User // invited users being served, by name
+	newPeer func(cfg Config, crypto *Crypto, sessionID, tokensPath string, peerTokens []string, peerWebPushToken string) *FCMTransport
+}
+
+// restartOnly lists the settings that differ between the startup config
+// and cfg but are only read at startup.
+func restartOnly(old, cfg Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("listen_addr", old.ListenAddr != cfg.ListenAddr)
+	check("admin_addr", old.AdminAddr != cfg.AdminAddr)
+	check("admin_token", old.AdminToken != cfg.AdminToken)
+	check("firebase_credentials", old.FCMCreds != cfg.FCMCreds || !bytes.Equal(old.fcmCredsJSON, cfg.fcmCredsJSON))
+	check("firebase_project", old.Project != cfg.Project)
+	check("sender_id", old.SenderID != cfg.SenderID)
+	check("identities", old.Identities != cfg.Identities)
+	check("webpush", old.WebPush != cfg.WebPush)
+	check("probe_chunk_size", old.ProbeChunkSize != cfg.ProbeChunkSize)
+	check("state_dir", old.StateDir != cfg.StateDir)
+	check("usage_report", old.UsageReport != cfg.UsageReport)
+	check("encrypt_credentials", old.EncryptCredentials != cfg.EncryptCredentials)
+	check("credentials_passphrase", old.CredentialsPassphrase != cfg.CredentialsPassphrase)
+	return changed
+}
+
+// Reload applies cfg and logs what changed.
+func (r *reloader) Reload(cfg Config) {
+	old := r.cfg
+	restart := restartOnly(r.boot, cfg)
+	for _, name := range restart {
+		reloadLog.Warn("setting changed; restart to apply", "setting", name)
+	}
+	if cfg.PSK != r.boot.PSK && (cfg.WebPush || (cfg.EncryptCredentials && cfg.CredentialsPassphrase == "")) {
+		reloadLog.Warn("the web push key and credential encryption keep using the old psk until restart")
+	}
+
+	applied := 0
+	if cfg.LogLevel != old.LogLevel || cfg.LogFormat != old.LogFormat || cfg.LogPrivacy != old.LogPrivacy {
+		if err := configureLogging(cfg); err != nil {
+			reloadLog.Error("keeping the logging settings", errAttr(err))
+		} else {
+			reloadLog.Info("logging settings changed", "level", logLevel.Level().String(), "format", cfg.LogFormat, "privacy", cfg.LogPrivacy)
+			applied++
+		}
+	}
+	if cfg.TraceFile != old.TraceFile {
+		if r.applyTrace(cfg.TraceFile) {
+			applied++
+		}
+	}
+	if r.router != nil {
+		applied += r.applyFCM(old, cfg)
+	}
+	r.cfg = cfg
+	reloadLog.Info("done", "applied", applied, "need_restart", len(restart))
+}
+
+// applyFCM updates the FCM peers and returns how many changes it applied.
+func (r *reloader) applyFCM(old, cfg Config) int {
+	applied := 0
+	def := r.srv.peer("fcm-peer")
+
+	if cfg.PSK != old.PSK {
+		if crypto, err := NewCrypto(cfg.PSK); err != nil {
+			reloadLog.Error("keeping the old psk", errAttr(err))
+		} else {
+			r.router.Remove(def.transport.Crypto().KeyID())
+			def.transport.SetCrypto(crypto)
+			r.router.Add(def.transport)
+			reloadLog.Info("psk changed; the client needs the new one too")
+			applied++
+		}
+	}
+	if tokens := cfg.peerTokens(); len(tokens) > 0 && !slices.Equal(tokens, old.peerTokens()) {
+		def.transport.SetPeerTokens(tokens)
+		reloadLog.Info("peer tokens changed", "tokens", len(tokens))
+		applied++
+	}
+	if cfg.PeerWebPushToken != "" && cfg.PeerWebPushToken != old.PeerWebPushToken {
+		def.transport.SetPeerWebPushToken(cfg.PeerWebPushToken)
+		reloadLog.Info("peer web push token changed")
+		applied++
+	}
+
+	// Transport settings apply to every peer.
+	peers := r.srv.Peers()
+	if cfg.Redundancy != old.Redundancy {
+		for _, p := range peers {
+			p.transport.SetRedundancy(cfg.Redundancy)
+		}
+		reloadLog.Info("redundancy changed", "redundancy", cfg.Redundancy)
+		applied++
+	}
+	if cfg.DisableCompression != old.DisableCompression {
+		for _, p := range peers {
+			p.transport.SetCompression(!cfg.DisableCompression)
+		}
+		reloadLog.Info("compression changed", "enabled", !cfg.DisableCompression)
+		applied++
+	}
+	if cfg.PayloadCodec != old.PayloadCodec || cfg.DataKeys != old.DataKeys {
+		if codec, err := CodecByName(cfg.PayloadCodec); err != nil {
+			reloadLog.Error("keeping the old codec", errAttr(err))
+		} else {
+			for _, p := range peers {
+				p.transport.SetCodec(codec, cfg.DataKeys)
+			}
+			reloadLog.Info("payload codec changed", "codec", cfg.PayloadCodec, "data_keys", max(cfg.DataKeys, 1))
+			applied++
+		}
+	}
+
+	return applied + r.applyUsers(cfg)
+}
+
+// applyTrace starts, moves or stops recording the trace.
+func (r *reloader) applyTrace(path string) bool {
+	if path == "" {
+		trace.Close()
+		reloadLog.Info("trace stopped")
+		return true
+	}
+	if err := trace.Open(path); err != nil {
+		reloadLog.Error("keeping the trace as it is", errAttr(err))
+		return false
+	}
+	reloadLog.Info("recording a trace", "path", path)
+	return true
+}
+
+// applyUsers reads the user list again, serving users that were added and
+// dropping those that were removed. A user whose key changed is replaced.
+// New users get the transport settings of cfg.
+func (r *reloader) applyUsers(cfg Config) int {
+	users, err := loadUsers(r.state.Path(usersFile))
+	if err != nil {
+		reloadLog.Error("keeping the current users", errAttr(err))
+		return 0
+	}
+	applied := 0
+	listed := make(map[string]bool, len(users))
+	for _, u := range users {
+		listed[u.Name] = true
+		cur, ok := r.users[u.Name]
+		if ok && cur.Key == u.Key {
+			continue
+		}
+		if ok {
+			r.removeUser(cur)
+		}
+		if r.addUser(u, cfg) {
+			applied++
+		}
+	}
+	for name, u := range r.users {
+		if !listed[name] {
+			r.removeUser(u)
+			applied++
+		}
+	}
+	return applied
+}
+
+func (r *reloader) addUser(u User, cfg Config) bool {
+	crypto, err := NewCrypto(u.Key)
+	if err != nil {
+		reloadLog.Error("adding user failed", "user", u.Name, errAttr(err))
+		return false
+	}
+	sessionID := userSessionID(u.Name)
+	transport := r.newPeer(cfg, crypto, sessionID, r.state.Path(userPeerTokensPath(u.Name)), nil, "")
+	transport.SetCredentials(r.tokens.Credentials(0))
+	r.router.Add(transport)
+	r.srv.startPeer(sessionID)
+	r.users[u.Name] = u
+	reloadLog.Info("user added; waiting for its HELLO", "user", u.Name)
+	return true
+}
+
+func (r *reloader) removeUser(u User) {
+	sessionID := userSessionID(u.Name)
+	if p := r.srv.peer(sessionID); p != nil {
+		r.router.Remove(p.transport.Crypto().KeyID())
+		r.srv.removePeer(sessionID)
+	}
+	delete(r.users, u.Name)
+	reloadLog.Info("user removed", "user", u.Name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// resolveSecret returns the secret a config value refers to, so secrets
+// need not sit in config.json:
+//
+//	env:NAME   the environment variable NAME
+//	fd:N       everything readable from file descriptor N
+//	file:PATH  the contents of PATH
+//
+// A trailing newline is dropped. Any other value is the secret itself.
+// A descriptor can only be read once, so its secret is remembered for when
+// the config is reloaded.
+func resolveSecret(v string) (string, error) {
+	kind, ref, ok := strings.Cut(v, ":")
+	if !ok {
+		return v, nil
+	}
+	var data []byte
+	switch kind {
+	case "env":
+		val, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return val, nil
+	case "fd":
+		fdSecretsMu.Lock()
+		defer fdSecretsMu.Unlock()
+		if secret, ok := fdSecrets[ref]; ok {
+			return secret, nil
+		}
+		fd, err := strconv.Atoi(ref)
+		if err != nil || fd < 0 {
+			return "", fmt.Errorf("bad file descriptor %q", ref)
+		}
+		f := os.NewFile(uintptr(fd), "fd:"+ref)
+		if f == nil {
+			return "", fmt.Errorf("bad file descriptor %q", ref)
+		}
+		defer f.Close()
+		if data, err = io.ReadAll(f); err != nil {
+			return "", fmt.Errorf("fd %s: %w", ref, err)
+		}
+		fdSecrets[ref] = strings.TrimSuffix(string(data), "\n")
+	case "file":
+		var err error
+		if data, err = os.ReadFile(ref); err != nil {
+			return "", err
+		}
+	default:
+		return v, nil
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+var (
+	fdSecretsMu sync.Mutex
+	fdSecrets   = make(map[string]string) // by descriptor number
+)
+
+// isSecretRef reports whether v refers to a secret held elsewhere, rather
+// than being a path or the secret itself.
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, "env:") || strings.HasPrefix(v, "fd:")
+}
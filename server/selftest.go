@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// selfTestTimeout is how long a self-test waits for its probes.
+	selfTestTimeout = 60 * time.Second
+	// selfTestInterval is how often a serving relay repeats the self-test.
+	selfTestInterval = time.Hour
+	// probeIDSize is the length of the ID opening each probe payload.
+	probeIDSize = 8
+)
+
+// selfTestSizes are the probe payload sizes: one fitting in a single
+// message, and larger ones that have to be chunked and reassembled.
+var selfTestSizes = []int{64, 4096, 16384}
+
+// SelfTest checks the whole path to our own identities: it sends encrypted
+// probe frames of several sizes through the FCM transport to our own tokens
+// and waits for MCS to deliver them back, reassembled and intact.
+type SelfTest struct {
+	transport *FCMTransport
+
+	mu      sync.Mutex
+	pending map[string]*pendingProbe // by probe ID
+	last    *SelfTestResult
+}
+
+type pendingProbe struct {
+	payload []byte
+	arrived chan bool // whether the payload arrived intact
+}
+
+// SelfTestResult is the outcome of one self-test run.
+type SelfTestResult struct {
+	At     time.Time     `json:"at"`
+	Passed bool          `json:"passed"`
+	Probes []ProbeResult `json:"probes"`
+}
+
+// ProbeResult is the outcome of one probe.
+type ProbeResult struct {
+	Size     int           `json:"size"`
+	Messages int           `json:"messages"` // FCM messages the probe was chunked into
+	Latency  time.Duration `json:"latency"`  // until the last chunk arrived
+	Error    string        `json:"error,omitempty"`
+
+	token   string
+	sendErr error // why FCM refused the probe, if it did
+}
+
+// NewSelfTest creates a self-test sending its probes through transport, and
+// takes over transport's probe handler.
+func NewSelfTest(transport *FCMTransport) *SelfTest {
+	s := &SelfTest{
+		transport: transport,
+		pending:   make(map[string]*pendingProbe),
+	}
+	transport.SetProbeHandler(s.handleProbe)
+	return s
+}
+
+func (s *SelfTest) handleProbe(f Frame) {
+	if len(f.Payload) < probeIDSize {
+		return
+	}
+	id := hex.EncodeToString(f.Payload[:probeIDSize])
+	s.mu.Lock()
+	p, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		selfTestLog.Debug("dropping stale probe", "probe", id)
+		return
+	}
+	p.arrived <- bytes.Equal(f.Payload, p.payload)
+}
+
+// Run sends a probe of each size, spread over tokens, and waits up to
+// timeout for all of them to come back.
+func (s *SelfTest) Run(tokens []string, timeout time.Duration) *SelfTestResult {
+	result := &SelfTestResult{At: time.Now(), Passed: true}
+	var wg sync.WaitGroup
+	result.Probes = make([]ProbeResult, len(selfTestSizes))
+	deadline := time.Now().Add(timeout)
+	for i, size := range selfTestSizes {
+		wg.Add(1)
+		go func(r *ProbeResult, token string, size int) {
+			defer wg.Done()
+			*r = s.probe(token, size, deadline)
+		}(&result.Probes[i], tokens[i%len(tokens)], size)
+	}
+	wg.Wait()
+	for _, p := range result.Probes {
+		if p.Error != "" {
+			result.Passed = false
+		}
+	}
+
+	s.mu.Lock()
+	s.last = result
+	s.mu.Unlock()
+	return result
+}
+
+func (s *SelfTest) probe(token string, size int, deadline time.Time) ProbeResult {
+	r := ProbeResult{Size: size, token: token}
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	id := hex.EncodeToString(payload[:probeIDSize])
+	p := &pendingProbe{payload: payload, arrived: make(chan bool, 1)}
+	s.mu.Lock()
+	s.pending[id] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	n, err := s.transport.SendProbe(token, Frame{Type: FrameProbe, Payload: payload})
+	r.Messages = n
+	if err != nil {
+		r.Error = fmt.Sprintf("send: %v", err)
+		r.sendErr = err
+		return r
+	}
+	select {
+	case intact := <-p.arrived:
+		r.Latency = time.Since(start)
+		if !intact {
+			r.Error = "arrived corrupted"
+		}
+	case <-time.After(time.Until(deadline)):
+		r.Error = "not delivered in time"
+	}
+	return r
+}
+
+// Last returns the outcome of the last run, or nil if none ran yet.
+func (s *SelfTest) Last() *SelfTestResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// String summarises the result on one line.
+func (r *SelfTestResult) String() string {
+	var b strings.Builder
+	if r.Passed {
+		b.WriteString("PASS")
+	} else {
+		b.WriteString("FAIL")
+	}
+	for _, p := range r.Probes {
+		fmt.Fprintf(&b, "; %dB in %d msg(s): ", p.Size, p.Messages)
+		if p.Error != "" {
+			b.WriteString(p.Error)
+		} else {
+			b.WriteString(p.Latency.Round(time.Millisecond).String())
+		}
+	}
+	return b.String()
+}
+
+// LogValue logs each probe as a group named by its size.
+func (r *SelfTestResult) LogValue() slog.Value {
+	attrs := make([]slog.Attr, len(r.Probes))
+	for i, p := range r.Probes {
+		probe := []any{"messages", p.Messages}
+		switch {
+		case p.sendErr != nil:
+			probe = append(probe, sensitiveErrAttr(p.sendErr))
+		case p.Error != "":
+			probe = append(probe, "err", p.Error)
+		default:
+			probe = append(probe, "latency", p.Latency.Round(time.Millisecond).String())
+		}
+		attrs[i] = slog.Group(fmt.Sprintf("%dB", p.Size), probe...)
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// waitLoggedIn waits until m has logged in to MCS, or timeout passes.
+func waitLoggedIn(m *MCSClient, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for m.State() != MCSLoggedIn {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -1,32 +1,57 @@
 package main
 
 import (
-	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Channel represents a single TCP connection tunnelled through the session.
 type Channel struct {
-	ID   uint16
-	Conn net.Conn
+	ID     uint16
+	Conn   net.Conn
+	Target string // host:port as the client asked for it
+	Opened time.Time
+
+	bytesUp    atomic.Uint64 // written to the target
+	bytesDown  atomic.Uint64 // read from the target
+	framesUp   atomic.Uint64 // DATA frames from the client
+	framesDown atomic.Uint64 // DATA frames to the client
 }
 
+// BytesUp returns how many bytes were written to the target.
+func (c *Channel) BytesUp() uint64 { return c.bytesUp.Load() }
+
+// BytesDown returns how many bytes were read from the target.
+func (c *Channel) BytesDown() uint64 { return c.bytesDown.Load() }
+
+// FramesUp returns how many DATA frames the client sent on the channel.
+func (c *Channel) FramesUp() uint64 { return c.framesUp.Load() }
+
+// FramesDown returns how many DATA frames were queued for the client.
+func (c *Channel) FramesDown() uint64 { return c.framesDown.Load() }
+
 // Session represents a connected client with its set of tunnelled channels.
 type Session struct {
 	DeviceID   string
+	Created    time.Time
 	mu         sync.RWMutex
 	channels   map[uint16]*Channel
 	nextChanID uint16
 	downstream chan Frame // frames queued for delivery to client
+	usage      *Usage
 }
 
 // NewSession creates a new client session.
 func NewSession(deviceID string) *Session {
 	return &Session{
 		DeviceID:   deviceID,
+		Created:    time.Now(),
 		channels:   make(map[uint16]*Channel),
 		downstream: make(chan Frame, 256),
+		usage:      &Usage{},
 	}
 }
 
@@ -57,6 +82,25 @@ func (s *Session) RemoveChannel(id uint16) {
 	}
 }
 
+// Channels returns the open channels, by ID.
+func (s *Session) Channels() []*Channel {
+	s.mu.RLock()
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	s.mu.RUnlock()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+	return channels
+}
+
+// ChannelCount returns the number of open channels.
+func (s *Session) ChannelCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.channels)
+}
+
 // CloseAll tears down every channel in the session.
 func (s *Session) CloseAll() {
 	s.mu.Lock()
@@ -73,21 +117,26 @@ func (s *Session) CloseAll() {
 func (s *Session) QueueDownstream(f Frame) {
 	select {
 	case s.downstream <- f:
+		s.usage.framesDown.Add(1)
 	default:
-		log.Printf("[session:%s] downstream queue full, dropping frame for channel %d", s.DeviceID, f.ChannelID)
+		sessionLog.Warn("downstream queue full; dropping frame", "session", s.DeviceID, "channel", f.ChannelID)
+		sessionQueueDrops.Inc(s.DeviceID)
 	}
 }
 
-// SessionManager manages all active client sessions.
+// SessionManager manages all active client sessions, and what each has
+// used since the last usage report.
 type SessionManager struct {
 	mu       sync.RWMutex
 	sessions map[string]*Session
+	usage    *usageLedger
 }
 
 // NewSessionManager creates a new manager.
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
 		sessions: make(map[string]*Session),
+		usage:    newUsageLedger(),
 	}
 }
 
@@ -99,8 +148,9 @@ func (m *SessionManager) GetOrCreate(deviceID string) *Session {
 		return s
 	}
 	s := NewSession(deviceID)
+	s.usage = m.usage.For(deviceID)
 	m.sessions[deviceID] = s
-	log.Printf("[sessions] new session for device %s", deviceID)
+	sessionLog.Info("new session", "session", deviceID)
 	return s
 }
 
@@ -111,6 +161,17 @@ func (m *SessionManager) Get(deviceID string) *Session {
 	return m.sessions[deviceID]
 }
 
+// All returns every session.
+func (m *SessionManager) All() []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		all = append(all, s)
+	}
+	return all
+}
+
 // Remove destroys a session.
 func (m *SessionManager) Remove(deviceID string) {
 	m.mu.Lock()
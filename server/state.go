@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StateDir is the directory holding the relay's runtime state: GCM
+// credentials, persistent-ID caches, heartbeat state, learned peer tokens
+// and the user list.
+type StateDir string
+
+// defaultStateDir is systemd's StateDirectory= when set, else the working
+// directory.
+func defaultStateDir() string {
+	if dirs := os.Getenv("STATE_DIRECTORY"); dirs != "" {
+		// systemd separates several state directories with colons.
+		dir, _, _ := strings.Cut(dirs, ":")
+		return dir
+	}
+	return "."
+}
+
+// Create makes the directory if it does not exist yet.
+func (d StateDir) Create() error {
+	return os.MkdirAll(string(d), 0700)
+}
+
+// Path returns the location of the state file name.
+func (d StateDir) Path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+// Lock takes an exclusive lock on the state file name, so two processes
+// never share one identity. The lock is held until the returned file is
+// closed or the process exits.
+func (d StateDir) Lock(name string) (*os.File, error) {
+	path := d.Path(name) + ".lock"
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		owner, _ := os.ReadFile(path)
+		f.Close()
+		if pid := strings.TrimSpace(string(owner)); pid != "" {
+			return nil, fmt.Errorf("%s is in use by process %s", d.Path(name), pid)
+		}
+		return nil, fmt.Errorf("%s is in use: %w", d.Path(name), err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenCheckInterval is how often each FCM token is validated.
+	tokenCheckInterval = 6 * time.Hour
+	// checkinInterval is how often each identity checks in again, roughly
+	// what Chrome does to keep its device registration alive.
+	checkinInterval = 48 * time.Hour
+)
+
+// TokenManager keeps our GCM identities registered. It periodically checks
+// in again and validates each FCM token, and re-registers an identity whose
+// token FCM reports as unregistered or whose credentials MCS rejects. The new
+// credentials are persisted and handed to the OnChange handlers, which update
+// the MCS clients and tell the peer where to reach us.
+type TokenManager struct {
+	senderID string
+	sender   *FCMSender
+	webPush  *WebPushSender // nil unless web push is enabled
+
+	mu       sync.Mutex // guards creds
+	creds    []*GCMCredentials
+	reg      []sync.Mutex // per identity; serialises its checkins and registrations
+	handlers []func(index int, creds *GCMCredentials)
+}
+
+// NewTokenManager manages the given identities, registered for senderID.
+func NewTokenManager(senderID string, sender *FCMSender, creds []*GCMCredentials) *TokenManager {
+	return &TokenManager{
+		senderID: senderID,
+		sender:   sender,
+		creds:    creds,
+		reg:      make([]sync.Mutex, len(creds)),
+	}
+}
+
+// SetWebPush makes re-registrations of the primary identity also obtain a
+// new web push token.
+func (t *TokenManager) SetWebPush(wp *WebPushSender) {
+	t.webPush = wp
+}
+
+// OnChange registers fn to be called after an identity got new credentials.
+// Must be called before Run.
+func (t *TokenManager) OnChange(fn func(index int, creds *GCMCredentials)) {
+	t.handlers = append(t.handlers, fn)
+}
+
+// Credentials returns the current credentials of identity i.
+func (t *TokenManager) Credentials(i int) *GCMCredentials {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.creds[i]
+}
+
+// Tokens returns the FCM tokens of all identities.
+func (t *TokenManager) Tokens() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tokens := make([]string, len(t.creds))
+	for i, c := range t.creds {
+		tokens[i] = c.FCMToken
+	}
+	return tokens
+}
+
+// Reregister discards identity i and registers a fresh one.
+func (t *TokenManager) Reregister(i int) (*GCMCredentials, error) {
+	return t.reregister(i, "")
+}
+
+// reregister replaces identity i. If token is set, it does so only while the
+// identity still has that token, so concurrent reports of the same dead token
+// register once.
+func (t *TokenManager) reregister(i int, token string) (*GCMCredentials, error) {
+	t.reg[i].Lock()
+	c := t.Credentials(i)
+	if token != "" && c.FCMToken != token {
+		t.reg[i].Unlock()
+		return c, nil
+	}
+	fresh, err := ReregisterGCM(t.senderID, c.store)
+	if err != nil {
+		t.reg[i].Unlock()
+		return nil, err
+	}
+	t.registerWebPush(i, fresh)
+	t.setCredentials(i, fresh)
+	t.reg[i].Unlock()
+
+	t.changed(i, fresh)
+	return fresh, nil
+}
+
+// HandleSendError re-registers the identity owning token if err says FCM no
+// longer knows it.
+func (t *TokenManager) HandleSendError(token string, err error) {
+	if !errors.Is(err, errTokenUnregistered) {
+		return
+	}
+	for i, tok := range t.Tokens() {
+		if tok == token {
+			gcmLog.Warn("FCM token unregistered; re-registering", "identity", i)
+			if _, err := t.reregister(i, token); err != nil {
+				gcmLog.Error("re-registration failed", "identity", i, sensitiveErrAttr(err))
+			}
+			return
+		}
+	}
+}
+
+// Check refreshes the checkin of identity i if it is due and validates its
+// FCM token, re-registering if FCM no longer knows it.
+func (t *TokenManager) Check(i int) {
+	t.reg[i].Lock()
+	c := t.Credentials(i)
+	if time.Since(time.Unix(c.CheckinAt, 0)) >= checkinInterval {
+		fresh, err := RefreshCheckin(c, t.senderID)
+		if err != nil {
+			t.reg[i].Unlock()
+			gcmLog.Warn("periodic checkin failed", "identity", i, sensitiveErrAttr(err))
+		} else {
+			renewed := fresh.FCMToken != c.FCMToken
+			if renewed {
+				t.registerWebPush(i, fresh)
+			}
+			t.setCredentials(i, fresh)
+			t.reg[i].Unlock()
+			gcmLog.Info("checked in", "identity", i)
+			if renewed {
+				t.changed(i, fresh)
+			}
+			c = fresh
+		}
+	} else {
+		t.reg[i].Unlock()
+	}
+
+	err := t.sender.ValidateToken(c.FCMToken)
+	if err != nil {
+		gcmLog.Warn("token validation failed", "identity", i, sensitiveErrAttr(err))
+		t.HandleSendError(c.FCMToken, err)
+	}
+}
+
+// Run checks every identity now and then every tokenCheckInterval, until
+// stop is closed.
+func (t *TokenManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		n := len(t.creds)
+		t.mu.Unlock()
+		for i := 0; i < n; i++ {
+			t.Check(i)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TokenManager) setCredentials(i int, creds *GCMCredentials) {
+	t.mu.Lock()
+	t.creds[i] = creds
+	t.mu.Unlock()
+}
+
+// registerWebPush gives the primary identity a web push token. Caller holds
+// t.reg[i].
+func (t *TokenManager) registerWebPush(i int, creds *GCMCredentials) {
+	if i != 0 || t.webPush == nil {
+		return
+	}
+	if err := RegisterWebPush(creds, t.webPush.PublicKey()); err != nil {
+		gcmLog.Error("web push registration failed", sensitiveErrAttr(err))
+	}
+}
+
+func (t *TokenManager) changed(i int, creds *GCMCredentials) {
+	gcmLog.Info("identity has a new FCM token", "identity", i, tokenAttr(creds.FCMToken))
+	for _, fn := range t.handlers {
+		fn(i, creds)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The trace records every frame and FCM message the transports send and
+// receive, one JSON object per line, for the decode command to make sense
+// of afterwards. It holds sizes, chunk positions and frame headers, never
+// payloads or tokens.
+var trace traceRecorder
+
+// Trace events.
+const (
+	traceMessage      = "message"       // an FCM data or web push message
+	traceFrame        = "frame"         // a frame, before chunking or after reassembly
+	traceDuplicate    = "duplicate"     // a received copy of a message already seen
+	traceSendError    = "send_error"    // a message FCM or web push refused
+	traceReceiveError = "receive_error" // a received message that yielded no frame
+	traceExpired      = "expired"       // a chunk group dropped before every chunk arrived
+)
+
+// TraceEvent is one line of a trace.
+type TraceEvent struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session,omitempty"`
+	Dir     string    `json:"dir"` // send or recv
+	Event   string    `json:"event"`
+	Path    string    `json:"path,omitempty"`  // data (FCM data messages) or raw (web push)
+	MID     string    `json:"mid,omitempty"`   // message or chunk group; frames carry the one they came in
+	Chunk   []int     `json:"chunk,omitempty"` // index and count within the group
+	Size    int       `json:"size,omitempty"`  // message payload, or sealed frame, in bytes
+
+	Frame   string `json:"frame,omitempty"` // frame type
+	Channel uint16 `json:"channel,omitempty"`
+	Len     int    `json:"len,omitempty"` // frame payload in bytes
+	Flags   int    `json:"flags,omitempty"`
+
+	Received int    `json:"received,omitempty"` // chunks of an expired group that arrived
+	Total    int    `json:"total,omitempty"`
+	Error    string `json:"error,omitempty"` // class of a send error, reason of a receive error
+}
+
+// traceRecorder appends events to the trace file while one is open.
+type traceRecorder struct {
+	on atomic.Bool
+
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	path string
+}
+
+// Open starts recording to path, appending to it, in place of the current
+// trace file.
+func (r *traceRecorder) Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f, r.enc, r.path = f, json.NewEncoder(f), path
+	r.on.Store(true)
+	return nil
+}
+
+// Close stops recording.
+func (r *traceRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.on.Store(false)
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.enc, r.path = nil, nil, ""
+	return err
+}
+
+// Path returns the file being recorded to, or "".
+func (r *traceRecorder) Path() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+// Enabled reports whether events are being recorded.
+func (r *traceRecorder) Enabled() bool {
+	return r.on.Load()
+}
+
+func (r *traceRecorder) record(ev TraceEvent) {
+	if !r.on.Load() {
+		return
+	}
+	ev.Time = time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enc != nil {
+		r.enc.Encode(ev)
+	}
+}
+
+// runDecode implements the decode command: it reads a trace and reports
+// what was sent and received, what failed to reassemble, and the frames of
+// each channel in order with the gaps between them.
+func runDecode(args []string) {
+	f := flag.NewFlagSet("decode", flag.ExitOnError)
+	session := f.String("session", "", "only show this session")
+	gap := f.Duration("gap", 5*time.Second, "report pauses longer than this within a channel")
+	f.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: push-tunnel decode [flags] trace.jsonl")
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(2)
+	}
+
+	events, err := readTrace(f.Arg(0), *session)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "decode: %v\n", err)
+		os.Exit(1)
+	}
+	if len(events) == 0 {
+		fmt.Println("no events")
+		return
+	}
+	printTraceSummary(events)
+	printReassembly(events)
+	printChannels(events, *gap)
+}
+
+func readTrace(path, session string) ([]TraceEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// A relay killed mid-write leaves half a line at the end; that is
+	// reported and skipped, while a bad line further up is an error.
+	var events []TraceEvent
+	var badErr error
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if badErr != nil {
+			return nil, badErr
+		}
+		var ev TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			badErr = fmt.Errorf("%s:%d: %w", path, line, err)
+			continue
+		}
+		if session == "" || ev.Session == session {
+			events = append(events, ev)
+		}
+	}
+	if badErr != nil {
+		fmt.Fprintf(os.Stderr, "decode: skipping the unfinished last line: %v\n", badErr)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, scanner.Err()
+}
+
+// printTraceSummary prints the span of the trace and, per direction, how
+// many frames and messages went by and what went wrong.
+func printTraceSummary(events []TraceEvent) {
+	first, last := events[0].Time, events[len(events)-1].Time
+	fmt.Printf("trace: %s to %s (%s), %d events\n",
+		first.Format(time.RFC3339), last.Format(time.RFC3339), last.Sub(first).Round(time.Millisecond), len(events))
+
+	for _, dir := range []string{"send", "recv"} {
+		counts := make(map[string]int)
+		frameTypes := make(map[string]int)
+		errors := make(map[string]int)
+		for _, ev := range events {
+			if ev.Dir != dir {
+				continue
+			}
+			counts[ev.Event]++
+			switch ev.Event {
+			case traceFrame:
+				frameTypes[ev.Frame]++
+			case traceSendError, traceReceiveError:
+				errors[ev.Error]++
+			}
+		}
+		line := fmt.Sprintf("%s: %d frame(s) (%s) in %d message(s)", dir, counts[traceFrame], formatCounts(frameTypes), counts[traceMessage])
+		if n := counts[traceDuplicate]; n > 0 {
+			line += fmt.Sprintf(", %d duplicate(s)", n)
+		}
+		if n := counts[traceSendError] + counts[traceReceiveError]; n > 0 {
+			line += fmt.Sprintf(", %d error(s) (%s)", n, formatCounts(errors))
+		}
+		fmt.Println(line)
+	}
+}
+
+// printReassembly lists the chunk groups that never became a frame: those
+// the relay gave up on, and those still incomplete when the trace ends.
+func printReassembly(events []TraceEvent) {
+	type group struct {
+		session, mid string
+		first        time.Time
+		chunks       map[int]bool
+		total        int
+		expired      bool
+	}
+	groups := make(map[string]*group)
+	var order []*group
+	for _, ev := range events {
+		if ev.Dir != "recv" || ev.MID == "" {
+			continue
+		}
+		if !(ev.Event == traceMessage && len(ev.Chunk) == 2) && ev.Event != traceExpired {
+			continue
+		}
+		key := ev.Session + "/" + ev.MID
+		g, ok := groups[key]
+		if !ok {
+			g = &group{session: ev.Session, mid: ev.MID, first: ev.Time, chunks: make(map[int]bool)}
+			groups[key] = g
+			order = append(order, g)
+		}
+		if ev.Event == traceExpired {
+			g.expired, g.total = true, ev.Total
+		} else if len(ev.Chunk) == 2 {
+			g.chunks[ev.Chunk[0]] = true
+			g.total = ev.Chunk[1]
+		}
+	}
+
+	var failed []string
+	for _, g := range order {
+		if len(g.chunks) >= g.total && !g.expired {
+			continue
+		}
+		var missing []string
+		for i := 0; i < g.total; i++ {
+			if !g.chunks[i] {
+				missing = append(missing, fmt.Sprint(i))
+			}
+		}
+		state := "incomplete at the end of the trace"
+		if g.expired {
+			state = "expired"
+		}
+		failed = append(failed, fmt.Sprintf("  %s %s %s: %d/%d chunk(s), missing %s, first at %s",
+			g.session, g.mid, state, len(g.chunks), g.total, strings.Join(missing, ","), g.first.Format("15:04:05.000")))
+	}
+	fmt.Printf("reassembly: %d chunk group(s) received, %d failed\n", len(order), len(failed))
+	for _, line := range failed {
+		fmt.Println(line)
+	}
+}
+
+// printChannels prints the frames of each channel in order, marking pauses
+// longer than gap. Channel 0 carries the control frames. Duplicates of a
+// message are shown on the channel of the frame it carried.
+func printChannels(events []TraceEvent, gap time.Duration) {
+	type channelKey struct {
+		session string
+		channel uint16
+	}
+	timelines := make(map[channelKey][]TraceEvent)
+	frameCounts := make(map[channelKey]int)
+	byMID := make(map[string]channelKey) // by session and message ID
+	var keys []channelKey
+	for _, ev := range events {
+		if ev.Event != traceFrame {
+			continue
+		}
+		key := channelKey{ev.Session, ev.Channel}
+		if _, ok := timelines[key]; !ok {
+			keys = append(keys, key)
+		}
+		timelines[key] = append(timelines[key], ev)
+		frameCounts[key]++
+		if ev.MID != "" {
+			byMID[ev.Session+"/"+ev.MID] = key
+		}
+	}
+	for _, ev := range events {
+		if ev.Event != traceDuplicate || ev.MID == "" {
+			continue
+		}
+		if key, ok := byMID[ev.Session+"/"+ev.MID]; ok {
+			timelines[key] = append(timelines[key], ev)
+		}
+	}
+	for _, timeline := range timelines {
+		sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].Time.Before(timeline[j].Time) })
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].session != keys[j].session {
+			return keys[i].session < keys[j].session
+		}
+		return keys[i].channel < keys[j].channel
+	})
+
+	for _, key := range keys {
+		frames := timelines[key]
+		name := fmt.Sprintf("channel %d", key.channel)
+		if key.channel == 0 {
+			name = "control"
+		}
+		start, end := frames[0].Time, frames[len(frames)-1].Time
+		fmt.Printf("\n%s %s: %d frame(s) over %s\n", key.session, name, frameCounts[key], end.Sub(start).Round(time.Millisecond))
+		for i, ev := range frames {
+			if i > 0 {
+				if pause := ev.Time.Sub(frames[i-1].Time); pause > gap {
+					fmt.Printf("  %12s  -- gap of %s\n", "", pause.Round(time.Millisecond))
+				}
+			}
+			if ev.Event == traceDuplicate {
+				what := ev.MID
+				if len(ev.Chunk) == 2 {
+					what += fmt.Sprintf(" chunk %d/%d", ev.Chunk[0], ev.Chunk[1])
+				}
+				fmt.Printf("  %12s  %s %-10s %6d B  %s\n", formatOffset(ev.Time.Sub(start)), ev.Dir, "duplicate", ev.Size, what)
+				continue
+			}
+			fmt.Printf("  %12s  %s %-10s %6d B\n", formatOffset(ev.Time.Sub(start)), ev.Dir, ev.Frame, ev.Len)
+		}
+	}
+}
+
+func formatOffset(d time.Duration) string {
+	return fmt.Sprintf("+%.3fs", d.Seconds())
+}
+
+// formatCounts formats counts as "name n, ..." by name.
+func formatCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, counts[name])
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
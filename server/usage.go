@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// usageFile is where the usage reports go unless usage_report says
+// otherwise, in the state directory.
+const usageFile = "usage.jsonl"
+
+// Usage counts the traffic of one session.
+type Usage struct {
+	channels         atomic.Uint64
+	bytesUp          atomic.Uint64
+	bytesDown        atomic.Uint64
+	framesUp         atomic.Uint64
+	framesDown       atomic.Uint64
+	messagesSent     atomic.Uint64
+	messagesReceived atomic.Uint64
+}
+
+// UsageTotals is what a Usage counted.
+type UsageTotals struct {
+	Channels         uint64 `json:"channels"`          // channels opened
+	BytesUp          uint64 `json:"bytes_up"`          // sent to targets
+	BytesDown        uint64 `json:"bytes_down"`        // received from targets
+	FramesUp         uint64 `json:"frames_up"`         // received from the client
+	FramesDown       uint64 `json:"frames_down"`       // queued for the client
+	MessagesSent     uint64 `json:"messages_sent"`     // FCM and web push messages, counting every copy
+	MessagesReceived uint64 `json:"messages_received"` // over MCS, without duplicates
+}
+
+// Totals returns the counts.
+func (u *Usage) Totals() UsageTotals {
+	return UsageTotals{
+		Channels:         u.channels.Load(),
+		BytesUp:          u.bytesUp.Load(),
+		BytesDown:        u.bytesDown.Load(),
+		FramesUp:         u.framesUp.Load(),
+		FramesDown:       u.framesDown.Load(),
+		MessagesSent:     u.messagesSent.Load(),
+		MessagesReceived: u.messagesReceived.Load(),
+	}
+}
+
+// take returns the counts and starts counting again from zero.
+func (u *Usage) take() UsageTotals {
+	return UsageTotals{
+		Channels:         u.channels.Swap(0),
+		BytesUp:          u.bytesUp.Swap(0),
+		BytesDown:        u.bytesDown.Swap(0),
+		FramesUp:         u.framesUp.Swap(0),
+		FramesDown:       u.framesDown.Swap(0),
+		MessagesSent:     u.messagesSent.Swap(0),
+		MessagesReceived: u.messagesReceived.Swap(0),
+	}
+}
+
+// giveBack adds t back to the counts.
+func (u *Usage) giveBack(t UsageTotals) {
+	u.channels.Add(t.Channels)
+	u.bytesUp.Add(t.BytesUp)
+	u.bytesDown.Add(t.BytesDown)
+	u.framesUp.Add(t.FramesUp)
+	u.framesDown.Add(t.FramesDown)
+	u.messagesSent.Add(t.MessagesSent)
+	u.messagesReceived.Add(t.MessagesReceived)
+}
+
+// usageLedger holds the usage of each session since the last report. It
+// outlives the sessions, so the traffic of a removed user is still
+// reported.
+type usageLedger struct {
+	mu        sync.Mutex
+	bySession map[string]*Usage
+	since     time.Time
+}
+
+func newUsageLedger() *usageLedger {
+	return &usageLedger{bySession: make(map[string]*Usage), since: time.Now()}
+}
+
+// For returns the usage of a session.
+func (l *usageLedger) For(sessionID string) *Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.bySession[sessionID]
+	if !ok {
+		u = &Usage{}
+		l.bySession[sessionID] = u
+	}
+	return u
+}
+
+// Since returns when the counts were last reset.
+func (l *usageLedger) Since() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.since
+}
+
+// take ends the period: it returns the usage of each session that had any
+// and resets the counts.
+func (l *usageLedger) take(now time.Time) (since time.Time, totals map[string]UsageTotals) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	since, l.since = l.since, now
+	totals = make(map[string]UsageTotals)
+	for id, u := range l.bySession {
+		if t := u.take(); t != (UsageTotals{}) {
+			totals[id] = t
+		}
+	}
+	return since, totals
+}
+
+// giveBack undoes a take whose report could not be written, so the next
+// report covers its period too.
+func (l *usageLedger) giveBack(since time.Time, totals map[string]UsageTotals) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.since = since
+	for id, t := range totals {
+		u, ok := l.bySession[id]
+		if !ok {
+			u = &Usage{}
+			l.bySession[id] = u
+		}
+		u.giveBack(t)
+	}
+}
+
+// plus returns the sum of t and o.
+func (t UsageTotals) plus(o UsageTotals) UsageTotals {
+	return UsageTotals{
+		Channels:         t.Channels + o.Channels,
+		BytesUp:          t.BytesUp + o.BytesUp,
+		BytesDown:        t.BytesDown + o.BytesDown,
+		FramesUp:         t.FramesUp + o.FramesUp,
+		FramesDown:       t.FramesDown + o.FramesDown,
+		MessagesSent:     t.MessagesSent + o.MessagesSent,
+		MessagesReceived: t.MessagesReceived + o.MessagesReceived,
+	}
+}
+
+// UsageReport is one line of the usage report: what a session used over a
+// period. Hour periods end on every hour UTC and when the relay stops; day
+// periods add them up and end at midnight UTC and when the relay stops. A
+// day's usage is the sum of either kind of line with its date.
+type UsageReport struct {
+	Period  string    `json:"period"` // hour or day
+	Date    string    `json:"date"`   // UTC day the period started on
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Session string    `json:"session"`
+	UsageTotals
+}
+
+// usageFlushInterval is how often the usage is written out, which bounds what
+// is lost if the relay dies without closing the reporter.
+const usageFlushInterval = time.Hour
+
+// usageReporter appends the ledger's usage to a JSON lines file hourly, and
+// each session's total for the day at midnight.
+type usageReporter struct {
+	ledger *usageLedger
+	path   string
+	stop   chan struct{}
+	done   chan struct{}
+	day    map[string]UsageReport // today's totals so far, by session
+}
+
+// startUsageReports reports the usage in ledger to path at the start of
+// every hour UTC, until closed.
+func startUsageReports(ledger *usageLedger, path string) *usageReporter {
+	r := &usageReporter{ledger: ledger, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go r.run()
+	return r
+}
+
+func (r *usageReporter) run() {
+	defer close(r.done)
+	for {
+		next := time.Now().UTC().Truncate(usageFlushInterval).Add(usageFlushInterval)
+		select {
+		case <-time.After(time.Until(next)):
+			r.report(false)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Close reports the usage so far and stops reporting.
+func (r *usageReporter) Close() error {
+	close(r.stop)
+	<-r.done
+	return r.report(true)
+}
+
+// report writes the usage since the last report, and the day totals if the
+// day is over or final is set. If that fails, the usage goes back into the
+// ledger for the next report.
+func (r *usageReporter) report(final bool) error {
+	now := time.Now()
+	since, totals := r.ledger.take(now)
+	date := since.UTC().Format(time.DateOnly)
+
+	day := make(map[string]UsageReport, len(r.day))
+	for id, d := range r.day {
+		day[id] = d
+	}
+	var lines []UsageReport
+	for id, t := range totals {
+		lines = append(lines, UsageReport{Period: "hour", Date: date, From: since, To: now, Session: id, UsageTotals: t})
+		d, ok := day[id]
+		if !ok {
+			d = UsageReport{Period: "day", Date: date, From: since, Session: id}
+		}
+		d.To, d.UsageTotals = now, d.UsageTotals.plus(t)
+		day[id] = d
+	}
+	if final || now.UTC().Format(time.DateOnly) != date {
+		for _, d := range day {
+			lines = append(lines, d)
+		}
+		day = nil
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Period != lines[j].Period {
+			return lines[i].Period == "hour"
+		}
+		return lines[i].Session < lines[j].Session
+	})
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, line := range lines {
+		enc.Encode(line)
+	}
+	if err := appendReport(r.path, buf.Bytes()); err != nil {
+		r.ledger.giveBack(since, totals)
+		relayLog.Error("writing usage report failed", errAttr(err))
+		return err
+	}
+	r.day = day
+	relayLog.Debug("wrote usage report", "sessions", len(totals), "path", r.path)
+	return nil
+}
+
+// appendReport appends lines to the file at path, all or nothing: a write
+// that fails partway is cut off again, so giving its usage back does not
+// count it twice.
+func appendReport(path string, lines []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Truncate(info.Size())
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usersFile lists the users invited with their own key.
+const usersFile = "users.json"
+
+var userNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// User is a client invited with its own key. Each user gets its own session
+// and transport on the relay.
+type User struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Created int64  `json:"created"` // unix seconds
+}
+
+// loadUsers reads the user list; a missing file means no users.
+func loadUsers(path string) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
+}
+
+// addUser appends u to the user list at path.
+func addUser(path string, u User) error {
+	if !userNameRe.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name %q (letters, digits, - and _)", u.Name)
+	}
+	users, err := loadUsers(path)
+	if err != nil {
+		return err
+	}
+	for _, existing := range users {
+		if existing.Name == u.Name {
+			return fmt.Errorf("user %q already exists", u.Name)
+		}
+	}
+	data, err := json.MarshalIndent(append(users, u), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// newUserKey returns a random 256-bit key.
+func newUserKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// userSessionID is the session a user's frames are relayed in.
+func userSessionID(name string) string {
+	return "fcm-peer:" + name
+}
+
+// userPeerTokensPath is where the tokens a user announced are kept.
+func userPeerTokensPath(name string) string {
+	return "peer_tokens." + name + ".json"
+}
+
+// keyRouter hands each incoming MCS message to the transport whose key
+// sealed it, going by the key ID the sender puts in the "u" data key.
+// Messages without one, or with an unknown one, go to the default transport.
+type keyRouter struct {
+	def *FCMTransport
+
+	mu   sync.RWMutex
+	byID map[string]*FCMTransport
+}
+
+func newKeyRouter(def *FCMTransport) *keyRouter {
+	return &keyRouter{def: def, byID: map[string]*FCMTransport{def.Crypto().KeyID(): def}}
+}
+
+// Add routes messages carrying t's key ID to t.
+func (r *keyRouter) Add(t *FCMTransport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byID[t.Crypto().KeyID()] = t
+}
+
+// Remove stops routing messages carrying keyID.
+func (r *keyRouter) Remove(keyID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byID, keyID)
+}
+
+// HandleMCSMessage dispatches dm to its transport.
+func (r *keyRouter) HandleMCSMessage(dm *DataMessage) {
+	r.mu.RLock()
+	t, ok := r.byID[dm.GetAppDataValue("u")]
+	r.mu.RUnlock()
+	if !ok {
+		t = r.def
+	}
+	t.HandleMCSMessage(dm)
+}
+
+// runInvite implements the invite command: it creates a user with a fresh
+// key and prints an invite carrying everything the user's client needs.
+func runInvite(args []string) {
+	f := newCommandFlags("invite")
+	name := f.String("name", "", "name of the user to invite (required)")
+	passphrase := f.String("passphrase", "", "encrypt the invite with the passphrase from `env:NAME, fd:N or file:PATH`")
+	cfg := f.parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "invite: -name is required")
+		os.Exit(2)
+	}
+	// Arguments are visible to every local user, so the passphrase itself
+	// never is one.
+	secret := *passphrase
+	if secret != "" {
+		if !isSecretRef(secret) && !strings.HasPrefix(secret, "file:") {
+			fmt.Fprintln(os.Stderr, "invite: -passphrase takes env:NAME, fd:N or file:PATH, not the passphrase itself")
+			os.Exit(2)
+		}
+		var err error
+		if secret, err = resolveSecret(secret); err != nil {
+			fmt.Fprintf(os.Stderr, "invite: passphrase: %v\n", err)
+			os.Exit(1)
+		}
+		if secret == "" {
+			fmt.Fprintln(os.Stderr, "invite: passphrase is empty")
+			os.Exit(1)
+		}
+	}
+	if err := writeInvite(cfg, *name, secret); err != nil {
+		fmt.Fprintf(os.Stderr, "invite: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func writeInvite(cfg Config, name, passphrase string) error {
+	if cfg.Project == "" || cfg.SenderID == "" {
+		return errors.New("relay config needs firebase_project and sender_id")
+	}
+	state := StateDir(cfg.StateDir)
+	serviceAccount := cfg.fcmCredsJSON
+	if len(serviceAccount) == 0 {
+		if cfg.FCMCreds == "" {
+			return errors.New("relay config needs firebase_credentials")
+		}
+		var err error
+		if serviceAccount, err = os.ReadFile(cfg.FCMCreds); err != nil {
+			return err
+		}
+	}
+
+	// The relay's own tokens, from its registered identities.
+	var tokens []string
+	for i := 0; i < max(cfg.Identities, 1); i++ {
+		creds, err := loadCredentials(cfg.credStore(state, i))
+		if err != nil {
+			return fmt.Errorf("no registered identity %d (run the relay once first): %w", i, err)
+		}
+		tokens = append(tokens, creds.FCMToken)
+	}
+
+	key, err := newUserKey()
+	if err != nil {
+		return err
+	}
+	inv := &Invite{
+		Name:          name,
+		Key:           key,
+		Project:       cfg.Project,
+		SenderID:      cfg.SenderID,
+		Credentials:   serviceAccount,
+		PeerFCMTokens: tokens,
+	}
+	if cfg.WebPush {
+		wp, err := NewWebPushSender(cfg.PSK)
+		if err != nil {
+			return err
+		}
+		inv.WebPushServerKey = wp.PublicKey()
+	}
+	uri, err := EncodeInvite(inv, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := addUser(state.Path(usersFile), User{Name: name, Key: key, Created: time.Now().Unix()}); err != nil {
+		return err
+	}
+
+	fmt.Println(uri)
+	fmt.Fprintf(os.Stderr, "user %q added to %s; reload (SIGHUP) or restart the relay to accept it\n", name, state.Path(usersFile))
+	return nil
+}
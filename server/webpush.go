@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	webPushURL      = "https://fcm.googleapis.com/fcm/send/"
+	webPushAudience = "https://fcm.googleapis.com"
+	webPushSubject  = "mailto:alerts@weatherpulse.app"
+	webPushTTL      = "2419200"
+	vapidInfo       = "push-tunnel-vapid"
+
+	// Web push bodies are limited to 4096 bytes. Each one starts with an
+	// RFC 8188 aes128gcm header followed by our raw envelope header.
+	webPushMaxBody     = 4096
+	rfc8188HeaderSize  = 16 + 4 + 1 // salt || record size || idlen (0)
+	rawEnvelopeSize    = 1 + 1 + 1 + 8
+	maxRawChunkDataLen = webPushMaxBody - rfc8188HeaderSize - rawEnvelopeSize
+)
+
+// WebPushSender delivers binary payloads through FCM's web push endpoint.
+// They arrive at the peer in the DataMessageStanza raw_data field, avoiding
+// the base64 expansion of data messages.
+//
+// The VAPID key pair is derived from the PSK, so both peers can compute it:
+// the receiver registers against the public key and the sender signs with the
+// private key.
+type WebPushSender struct {
+	key        *ecdsa.PrivateKey
+	publicKey  string // base64url uncompressed point, as used by "k=" and register3
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	jwt    string
+	jwtExp time.Time
+}
+
+// NewWebPushSender derives the VAPID key pair from the PSK.
+func NewWebPushSender(psk string) (*WebPushSender, error) {
+	key, err := deriveVAPIDKey(psk)
+	if err != nil {
+		return nil, err
+	}
+	pub := elliptic.Marshal(elliptic.P256(), key.X, key.Y)
+	return &WebPushSender{
+		key:        key,
+		publicKey:  base64.RawURLEncoding.EncodeToString(pub),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// PublicKey returns the VAPID application server key used when registering
+// for web push.
+func (w *WebPushSender) PublicKey() string {
+	return w.publicKey
+}
+
+func deriveVAPIDKey(psk string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	hk := hkdf.New(sha256.New, []byte(psk), []byte(hkdfSalt), []byte(vapidInfo))
+	d := make([]byte, 32)
+	// Rejection-sample until the scalar is in [1, N-1]; a retry is
+	// astronomically unlikely but keeps the derivation total.
+	for i := 0; i < 16; i++ {
+		if _, err := io.ReadFull(hk, d); err != nil {
+			return nil, fmt.Errorf("hkdf: %w", err)
+		}
+		k := new(big.Int).SetBytes(d)
+		if k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+			continue
+		}
+		key := &ecdsa.PrivateKey{D: k}
+		key.PublicKey.Curve = curve
+		key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+		return key, nil
+	}
+	return nil, errors.New("vapid: could not derive key")
+}
+
+// vapidJWT returns a cached ES256 VAPID token, refreshing it before expiry.
+func (w *WebPushSender) vapidJWT() (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.jwt != "" && time.Until(w.jwtExp) > time.Hour {
+		return w.jwt, nil
+	}
+
+	exp := time.Now().Add(12 * time.Hour)
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": webPushAudience,
+		"exp": exp.Unix(),
+		"sub": webPushSubject,
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, w.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("vapid sign: %w", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	w.jwt = signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	w.jwtExp = exp
+	return w.jwt, nil
+}
+
+// errWebPushRejected is returned (wrapped) when the push service refuses a
+// message.
+var errWebPushRejected = errors.New("webpush")
+
+// SendRaw posts body to the web push endpoint for token. body must already
+// carry an RFC 8188 header (see wrapRFC8188).
+func (w *WebPushSender) SendRaw(token string, body []byte) error {
+	err := w.post(token, body)
+	webPushSends.Inc(sendResult(err))
+	return err
+}
+
+func (w *WebPushSender) post(token string, body []byte) error {
+	if len(body) > webPushMaxBody {
+		return fmt.Errorf("%w: web push body %d > %d", errMessageTooBig, len(body), webPushMaxBody)
+	}
+	jwt, err := w.vapidJWT()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webPushURL+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("TTL", webPushTTL)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", jwt, w.publicKey))
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webpush send: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		fcmLog.Debug("web push API response", "status", resp.StatusCode, "body", string(respBody))
+		return fmt.Errorf("%w: %d: %s", errWebPushRejected, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// wrapRFC8188 prefixes data with a well-formed aes128gcm content coding
+// header. The push service only forwards the body, but a plausible header
+// keeps it indistinguishable from browser web push traffic.
+func wrapRFC8188(data []byte) []byte {
+	buf := make([]byte, rfc8188HeaderSize, rfc8188HeaderSize+len(data))
+	rand.Read(buf[:16])
+	binary.BigEndian.PutUint32(buf[16:20], webPushMaxBody)
+	buf[20] = 0 // idlen
+	return append(buf, data...)
+}
+
+// unwrapRFC8188 strips the aes128gcm header from a received raw_data body.
+func unwrapRFC8188(body []byte) ([]byte, error) {
+	if len(body) < rfc8188HeaderSize {
+		return nil, errors.New("raw_data shorter than aes128gcm header")
+	}
+	idLen := int(body[20])
+	if len(body) < rfc8188HeaderSize+idLen {
+		return nil, errors.New("raw_data truncated in aes128gcm key id")
+	}
+	return body[rfc8188HeaderSize+idLen:], nil
+}
+
+// rawEnvelope is the binary counterpart of the mid/ci/ct/f data keys.
+//
+//	[1 byte: flags] [1 byte: chunk index] [1 byte: chunk count] [8 bytes: message id]
+type rawEnvelope struct {
+	flags byte
+	index byte
+	count byte
+	mid   [8]byte
+}
+
+func encodeRawEnvelope(env rawEnvelope, chunk []byte) []byte {
+	buf := make([]byte, rawEnvelopeSize, rawEnvelopeSize+len(chunk))
+	buf[0] = env.flags
+	buf[1] = env.index
+	buf[2] = env.count
+	copy(buf[3:], env.mid[:])
+	return append(buf, chunk...)
+}
+
+func decodeRawEnvelope(data []byte) (rawEnvelope, []byte, error) {
+	if len(data) < rawEnvelopeSize {
+		return rawEnvelope{}, nil, errors.New("raw envelope too short")
+	}
+	var env rawEnvelope
+	env.flags = data[0]
+	env.index = data[1]
+	env.count = data[2]
+	copy(env.mid[:], data[3:rawEnvelopeSize])
+	if env.count == 0 || env.index >= env.count {
+		return rawEnvelope{}, nil, fmt.Errorf("invalid raw chunk %d/%d", env.index, env.count)
+	}
+	return env, data[rawEnvelopeSize:], nil
+}